@@ -1,10 +1,14 @@
 package tftpOctet
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 )
 
 const (
@@ -12,7 +16,8 @@ const (
 )
 
 var (
-	readWriteLock sync.RWMutex//Mutex lock for all reads and writes. Reads can happen concurrently while a write blocks all
+	ERR_NO_TRANSFER_SIZE = errors.New("Server did not report transfer size")
+	errSizeQueried = errors.New("Transfer size received")//aborts a read once the server reported the size
 )
 
 
@@ -22,57 +27,303 @@ var (
 
 type Client struct {
 	RemoteAddr 	*net.UDPAddr//UDP Addr to communicate with server
-	Log 		*log.Logger//log to print out important events of the client
+	Log 		*log.Logger//log to print out important events of the client. nil logs nothing
+	BlockSize 	int//block size to request from the server (8-65464). 0 uses the default 512
+	WindowSize 	int//blocks the server may send before waiting for an ACK (RFC 7440). 0 sends one block at a time
+	Timeout 	time.Duration//time to wait before resending a packet, also requested from the server. Both sides round it up to whole seconds. 0 uses the defaults
+	Retries 	int//attempts at sending each packet before a transfer fails. 0 uses DEFAULT_RETRIES
+	AdaptiveTimeout bool//resend after about the measured round trip time instead of always waiting Timeout, which is only the first guess. Transfers still give up no sooner than with Timeout
+	MinTimeout 	time.Duration//shortest adaptive timeout. 0 uses DEFAULT_MIN_ADAPTIVE_TIMEOUT
+	MaxTimeout 	time.Duration//longest adaptive timeout. 0 uses DEFAULT_MAX_ADAPTIVE_TIMEOUT
+	Rollover 	uint16//block number that follows 65535 in large transfers: 0 (default) or 1. Has to match the server
+	Locks 		FileLocker//serializes reads and writes of the same file on the same server. nil shares a lock manager with all other clients
+	Mode 		string//transfer mode used by Open, Create, Get and Put. "" uses octet
+	TransferIP 	net.IP//address transfer sockets are bound to. nil binds all addresses
+	TransferPorts 	PortRange//ports transfer sockets are bound to. The zero value uses any free port
+	Transport 	Transport//opens the client's sockets. nil uses UDP
 }
 
 //client function called when client wants to write file to server
-//uses sender type to send data to server via RemoteAddr connection
+//uses sender type to send data to server via RemoteAddr connection.
+//Returns nil only once the server acknowledged all of the file. If the server answers with an
+//ERROR packet the returned error is a *TFTPError, ERR_SEND_TIMEOUT means it stopped answering,
+//and closing the pipe with an error fails the transfer with that error
 func (c Client) WriteFile(filename string, mode string, handler func(w *io.PipeWriter)) error {
-	addr, err := net.ResolveUDPAddr(UDP_NET, ":0")
+	return c.writeFile(context.Background(), filename, mode, -1, handler)
+}
+
+//same as WriteFile but announces the size of the file to the server with tsize
+//so the server can refuse it before any data is sent. size is ignored if negative or in netascii mode
+func (c Client) WriteFileSize(filename string, mode string, size int64, handler func(w *io.PipeWriter)) error {
+	return c.writeFile(context.Background(), filename, mode, size, handler)
+}
+
+//same as WriteFile but gives up as soon as ctx is done. The server is sent an ERROR packet,
+//the pipe is closed with ctx.Err() and ctx.Err() is returned
+func (c Client) WriteFileContext(ctx context.Context, filename string, mode string, handler func(w *io.PipeWriter)) error {
+	return c.writeFile(ctx, filename, mode, -1, handler)
+}
+
+func (c Client) writeFile(ctx context.Context, filename string, mode string, size int64, handler func(w *io.PipeWriter)) error {
+	options, err := c.requestOptions()
 	if err != nil {
 		return err
 	}
-	conn, err := net.ListenUDP(UDP_NET, addr)
+	//netascii files grow on the wire, so their size is not what the server receives
+	if size >= 0 && !isNetascii(mode) {
+		options[OPTION_TSIZE] = strconv.FormatInt(size, 10)
+	}
+	conn, err := c.transferConn()
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 	read, write := io.Pipe()
-	send := &sender{c.RemoteAddr, conn, read, filename, mode, c.Log}
+	send := c.newSender(conn, read, filename, mode, options)
 	var wait sync.WaitGroup
-	readWriteLock.Lock()
+	locks, name := c.fileLock(filename)
+	locks.Lock(name)
+	defer locks.Unlock(name)
 	wait.Add(1)
 	go func() {
-		handler(write)
 		defer wait.Done()
+		//a handler that returns without closing the pipe has written all of the file
+		defer write.Close()
+		handler(write)
 	}()
-	send.run(false)
+	err = send.run(ctx, false)
 	wait.Wait()
-	defer readWriteLock.Unlock()
-	return nil
+	return err
 }
 
 //client function called when client wants to read file from server
-//uses receiver type to receive data from server via RemoteAddr connection
+//uses receiver type to receive data from server via RemoteAddr connection.
+//Returns nil only once all of the file was handed to the handler. If the server answers with an
+//ERROR packet the returned error is a *TFTPError, ERR_RECEIVE_TIMEOUT means it stopped sending,
+//and closing the pipe with an error, or returning before reading all of it, fails the transfer
 func (c Client) ReadFile(filename string, mode string, handler func(r *io.PipeReader)) error {
-	addr, err := net.ResolveUDPAddr(UDP_NET, ":0")
+	return c.ReadFileContext(context.Background(), filename, mode, handler)
+}
+
+//same as ReadFile but gives up as soon as ctx is done. The server is sent an ERROR packet,
+//the pipe is closed with ctx.Err() and ctx.Err() is returned
+func (c Client) ReadFileContext(ctx context.Context, filename string, mode string, handler func(r *io.PipeReader)) error {
+	options, err := c.requestOptions()
 	if err != nil {
 		return err
 	}
-	conn, err := net.ListenUDP(UDP_NET, addr)
+	conn, err := c.transferConn()
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 	read, write := io.Pipe()
-	receive := &receiver{c.RemoteAddr, conn, write, filename, mode, c.Log}
+	receive := c.newReceiver(conn, write, filename, mode, options)
 	var wait sync.WaitGroup
-	readWriteLock.RLock()
+	locks, name := c.fileLock(filename)
+	locks.RLock(name)
+	defer locks.RUnlock(name)
 	wait.Add(1)
 	go func() {
+		defer wait.Done()
+		//a handler that returns before reading all of the file aborts the transfer
+		defer read.Close()
 		handler(read)
-		wait.Done()
 	}()
-	receive.run(false)
+	err = receive.run(ctx, false)
 	wait.Wait()
-	defer readWriteLock.RUnlock()
-	return nil
-}
\ No newline at end of file
+	return err
+}
+
+//sender of a file to the client's server, configured like the client
+func (c Client) newSender(conn net.PacketConn, read *io.PipeReader, filename string, mode string, options map[string]string) *sender {
+	return &sender{RemoteAddr: c.RemoteAddr, Conn: conn, Reader: read, FileName: filename, Mode: mode, Options: options, Timeout: c.Timeout, Retries: c.Retries, Adaptive: c.AdaptiveTimeout, MinTimeout: c.MinTimeout, MaxTimeout: c.MaxTimeout, Rollover: c.Rollover, Log: c.Log}
+}
+
+//receiver of a file from the client's server, configured like the client
+func (c Client) newReceiver(conn net.PacketConn, write *io.PipeWriter, filename string, mode string, options map[string]string) *receiver {
+	return &receiver{RemoteAddr: c.RemoteAddr, Conn: conn, Writer: write, FileName: filename, Mode: mode, Options: options, Timeout: c.Timeout, Retries: c.Retries, Adaptive: c.AdaptiveTimeout, MinTimeout: c.MinTimeout, MaxTimeout: c.MaxTimeout, Rollover: c.Rollover, Log: c.Log}
+}
+
+//lock manager and lock name for a file on the client's server
+//the same file name on different servers is a different file
+func (c Client) fileLock(filename string) (FileLocker, string) {
+	locks := c.Locks
+	if locks == nil {
+		locks = defaultFileLocker
+	}
+	return locks, c.RemoteAddr.String() + "/" + filename
+}
+
+//asks the server for the size of a file with tsize (RFC 2349)
+//servers do not know the size of netascii files, which fails with ERR_NO_TRANSFER_SIZE
+//the read request is aborted as soon as the server answers, before any data is sent
+func (c Client) FileSize(filename string, mode string) (int64, error) {
+	options, err := c.requestOptions()
+	if err != nil {
+		return -1, err
+	}
+	options[OPTION_TSIZE] = "0"
+	conn, err := c.transferConn()
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	size := int64(-1)
+	read, write := io.Pipe()
+	defer read.Close()
+	receive := c.newReceiver(conn, write, filename, mode, options)
+	receive.Negotiated = func(options map[string]string) error {
+		size = transferSize(options)
+		if size < 0 {
+			return ERR_NO_TRANSFER_SIZE
+		}
+		return errSizeQueried
+	}
+	err = receive.run(context.Background(), false)
+	if err != errSizeQueried {
+		return -1, err
+	}
+	return size, nil
+}
+
+//opens a file on the server for reading
+//returns once the server has started sending the file, so a refused read is reported here.
+//Errors during the transfer are returned by Read. Closing the file before
+//all of it was read aborts the transfer.
+//The file stays locked like for ReadFile (see Locks) until it was read to the end or closed:
+//a Create of the same file through the same lock manager blocks until then, even in the same goroutine
+func (c Client) Open(filename string) (io.ReadCloser, error) {
+	options, err := c.requestOptions()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.transferConn()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	read, write := io.Pipe()
+	receive := c.newReceiver(conn, write, filename, c.mode(), options)
+	started := make(chan struct{})
+	receive.Negotiated = func(options map[string]string) error {
+		close(started)
+		return nil
+	}
+	file := &remoteReader{PipeReader: read, cancel: cancel, done: make(chan struct{})}
+	result := make(chan error, 1)
+	locks, name := c.fileLock(filename)
+	locks.RLock(name)
+	go func() {
+		defer close(file.done)
+		defer locks.RUnlock(name)
+		defer conn.Close()
+		result <- receive.run(ctx, false)
+	}()
+	select {
+		case <-started:
+			return file, nil
+		case err = <-result:
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			return file, nil
+	}
+}
+
+//creates a file on the server and returns a writer for it
+//Errors during the transfer are returned by Write. Close ends the file and
+//returns once the server has received all of it, reporting how the transfer went.
+//The file stays locked like for WriteFile (see Locks) until Close returns: any Open or Create of
+//the same file through the same lock manager blocks until then, even in the same goroutine
+func (c Client) Create(filename string) (io.WriteCloser, error) {
+	options, err := c.requestOptions()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.transferConn()
+	if err != nil {
+		return nil, err
+	}
+	read, write := io.Pipe()
+	send := c.newSender(conn, read, filename, c.mode(), options)
+	file := &remoteWriter{PipeWriter: write, done: make(chan struct{})}
+	locks, name := c.fileLock(filename)
+	locks.Lock(name)
+	go func() {
+		defer close(file.done)
+		defer locks.Unlock(name)
+		defer conn.Close()
+		file.err = send.run(context.Background(), false)
+	}()
+	return file, nil
+}
+
+//reads a file from the server into w
+//returns the number of bytes written to w
+func (c Client) Get(filename string, w io.Writer) (int64, error) {
+	var copied int64
+	err := c.ReadFile(filename, c.mode(), func(r *io.PipeReader) {
+		var copyErr error
+		copied, copyErr = io.Copy(w, r)
+		//a failed write to w aborts the transfer
+		r.CloseWithError(copyErr)
+	})
+	return copied, err
+}
+
+//writes the contents of r to a file on the server
+//the size left in r is announced to the server when r has a Len, Size or Stat method.
+//Returns the number of bytes read from r
+func (c Client) Put(filename string, r io.Reader) (int64, error) {
+	var copied int64
+	err := c.writeFile(context.Background(), filename, c.mode(), streamSize(r), func(w *io.PipeWriter) {
+		var copyErr error
+		copied, copyErr = io.Copy(w, r)
+		//a failed read from r aborts the transfer
+		w.CloseWithError(copyErr)
+	})
+	return copied, err
+}
+
+//file being read from the server by Open
+type remoteReader struct {
+	*io.PipeReader
+	cancel 	context.CancelFunc//aborts the transfer
+	done 	chan struct{}//closed once the transfer is over
+}
+
+//aborts the transfer unless it already finished
+func (r *remoteReader) Close() error {
+	r.cancel()
+	<-r.done
+	return r.PipeReader.Close()
+}
+
+//file being written to the server by Create
+type remoteWriter struct {
+	*io.PipeWriter
+	done 	chan struct{}//closed once the transfer is over
+	err 	error//result of the transfer
+}
+
+//ends the file and waits for the server to receive it
+func (w *remoteWriter) Close() error {
+	w.PipeWriter.Close()
+	<-w.done
+	return w.err
+}
+
+//socket for a transfer with the server
+func (c Client) transferConn() (net.PacketConn, error) {
+	return c.TransferPorts.listen(defaultTransport(c.Transport), c.TransferIP)
+}
+
+//transfer mode used by Open, Create, Get and Put
+func (c Client) mode() string {
+	if c.Mode == "" {
+		return MODE_OCTET
+	}
+	return c.Mode
+}
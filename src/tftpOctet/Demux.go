@@ -0,0 +1,91 @@
+package tftpOctet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEMUX_QUEUE_SIZE = 64 //packets waiting for a transfer on the listening socket before more are dropped
+)
+
+//-------------------------------------------------------------------------------------------------------
+//Single port mode. All transfers run on the server's listening socket, and packets
+//read from it are handed to the transfer of the client that sent them.
+//Packets from clients without a transfer are requests
+//-------------------------------------------------------------------------------------------------------
+
+//transfer running on the listening socket
+//reads return the packets the server routed to it, writes go out through the listening socket
+type demuxConn struct {
+	net.PacketConn//listening socket
+	server 		*Server
+	remote 		*net.UDPAddr//client of the transfer
+	queue 		*packetQueue//packets sent by the client
+	finished 	atomic.Bool//transfer is over and only waits for repeats of its last block
+}
+
+//registers a transfer with addr on the listening socket
+func (s *Server) demuxConn(conn net.PacketConn, addr *net.UDPAddr) (*demuxConn, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.routes[addr.String()]; exists {
+		return nil, fmt.Errorf("Transfer with %v is already running", addr)
+	}
+	if s.routes == nil {
+		s.routes = map[string]*demuxConn{}
+	}
+	d := &demuxConn{PacketConn: conn, server: s, remote: addr, queue: newPacketQueue(DEMUX_QUEUE_SIZE)}
+	s.routes[addr.String()] = d
+	return d, nil
+}
+
+//hands a packet to the transfer with addr
+//returns false if there is none, which makes the packet a request
+func (s *Server) demux(addr *net.UDPAddr, packet []byte) bool {
+	s.mutex.Lock()
+	d, exists := s.routes[addr.String()]
+	s.mutex.Unlock()
+	if !exists {
+		return false
+	}
+	if d.finished.Load() && len(packet) >= 2 {
+		//a finished transfer gives way to a new request from its client
+		opcode := binary.BigEndian.Uint16(packet)
+		if opcode == OPCODE_RRQ || opcode == OPCODE_WRQ {
+			d.Close()
+			return false
+		}
+	}
+	//a transfer that is not keeping up loses the packet
+	d.queue.push(d.remote, packet)
+	return true
+}
+
+func (d *demuxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return d.queue.read(b)
+}
+
+func (d *demuxConn) SetReadDeadline(t time.Time) error {
+	d.queue.setReadDeadline(t)
+	return nil
+}
+
+func (d *demuxConn) SetDeadline(t time.Time) error {
+	return d.SetReadDeadline(t)
+}
+
+//ends the transfer. Packets from its client are requests again
+//the listening socket stays open
+func (d *demuxConn) Close() error {
+	d.server.mutex.Lock()
+	defer d.server.mutex.Unlock()
+	if d.server.routes[d.remote.String()] == d {
+		delete(d.server.routes, d.remote.String())
+		d.queue.close()
+	}
+	return nil
+}
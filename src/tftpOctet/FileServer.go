@@ -0,0 +1,245 @@
+package tftpOctet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	UPLOAD_SUFFIX = ".tftp" //ends the names of the temporary files uploads are staged in
+)
+
+//-------------------------------------------------------------------------------------------------------
+//FileServer is a ReadHandler and WriteHandler that serves the files in a directory.
+//Clients can not reach anything outside of it: file names with ".." and absolute paths
+//are refused, and so are symbolic links that lead out of the directory.
+//A file written by a client only appears once all of it was received. Until then it is staged in a
+//temporary file ".<name>.<number>.tftp" next to it, which clients can neither read nor write. One is
+//only left behind if the server stops in the middle of an upload, and can be deleted at any time
+//-------------------------------------------------------------------------------------------------------
+
+type FileServer struct {
+	Dir 		string//directory to serve
+	FS 			fs.FS//optional. Files to serve when Dir is empty, always read only
+	ReadOnly 	bool//refuse all writes
+}
+
+//opens the requested file for the server to send
+func (f *FileServer) ServeRead(r *Request) (io.WriterTo, error) {
+	name, err := cleanPath(r.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if f.Dir == "" {
+		if f.FS == nil {
+			return nil, &TFTPError{ERROR_FILE_NOT_FOUND, fmt.Sprintf("File not found: %s", r.FileName)}
+		}
+		file, err := f.FS.Open(name)
+		if err != nil {
+			return nil, openError(r.FileName, err)
+		}
+		return checkRegular(r.FileName, fsFile{file})
+	}
+	root, err := os.OpenRoot(f.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	file, err := root.Open(name)
+	if err != nil {
+		return nil, openError(r.FileName, err)
+	}
+	return checkRegular(r.FileName, file)
+}
+
+//creates or replaces the requested file for the server to store what it receives
+//the data is staged in a temporary file that only replaces the file once the transfer succeeded
+func (f *FileServer) ServeWrite(r *Request) (io.ReaderFrom, error) {
+	if f.ReadOnly || f.Dir == "" {
+		return nil, &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Writes are not allowed: %s", r.FileName)}
+	}
+	name, err := cleanPath(r.FileName)
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(f.Dir)
+	if err != nil {
+		return nil, err
+	}
+	//refuse directories and paths out of the directory before anything is received
+	info, err := root.Stat(name)
+	if err == nil && !info.Mode().IsRegular() {
+		root.Close()
+		return nil, &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Not a file: %s", r.FileName)}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		root.Close()
+		return nil, openError(r.FileName, err)
+	}
+	upload, err := newUpload(root, name)
+	if err != nil {
+		root.Close()
+		return nil, openError(r.FileName, err)
+	}
+	return upload, nil
+}
+
+//tells the server whether a file exists so it can enforce its WritePolicy
+func (f *FileServer) FileExists(filename string) (bool, error) {
+	name, err := cleanPath(filename)
+	if err != nil {
+		return false, err
+	}
+	if f.Dir == "" {
+		if f.FS == nil {
+			return false, nil
+		}
+		_, err = fs.Stat(f.FS, name)
+	} else {
+		var root *os.Root
+		root, err = os.OpenRoot(f.Dir)
+		if err != nil {
+			return false, err
+		}
+		defer root.Close()
+		_, err = root.Stat(name)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, openError(filename, err)
+	}
+	return true, nil
+}
+
+//turns a file name sent by a client into a path relative to the served directory
+//backslashes separate directories like slashes do
+func cleanPath(filename string) (string, error) {
+	name := strings.ReplaceAll(filename, "\\", "/")
+	if path.IsAbs(name) {
+		return "", &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Absolute paths are not allowed: %s", filename)}
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Paths with .. are not allowed: %s", filename)}
+		}
+	}
+	name = path.Clean(name)
+	if name == "." || !fs.ValidPath(name) {
+		return "", &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Invalid file name: %s", filename)}
+	}
+	//half-written files are never served, and writes must not race their commit
+	if isUploadName(path.Base(name)) {
+		return "", &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Access denied: %s", filename)}
+	}
+	return name, nil
+}
+
+//whether base is named like the temporary file of an upload: .<name>.<number>.tftp
+func isUploadName(base string) bool {
+	if !strings.HasPrefix(base, ".") || !strings.HasSuffix(base, UPLOAD_SUFFIX) {
+		return false
+	}
+	rest := strings.TrimSuffix(base, UPLOAD_SUFFIX)
+	dot := strings.LastIndex(rest, ".")
+	if dot <= 0 {
+		return false
+	}
+	_, err := strconv.ParseUint(rest[dot+1:], 10, 32)
+	return err == nil
+}
+
+//error sent to a client when a file could not be opened
+//anything but a missing file, including a path leading out of the directory, is an access violation
+func openError(filename string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &TFTPError{ERROR_FILE_NOT_FOUND, fmt.Sprintf("File not found: %s", filename)}
+	}
+	return &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Access denied: %s", filename)}
+}
+
+//file opened for a read request
+type servedFile interface {
+	io.WriterTo
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+//only regular files are sent, not directories or devices
+func checkRegular(filename string, file servedFile) (io.WriterTo, error) {
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Not a file: %s", filename)}
+	}
+	return file, nil
+}
+
+//file of an fs.FS that can be sent by the server
+type fsFile struct {
+	fs.File
+}
+
+func (f fsFile) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, f.File)
+}
+
+//file being written by a client
+//data goes to a temporary file next to it, which replaces the file once all of it was received
+type upload struct {
+	root 		*os.Root//directory being served
+	name 		string//file being written
+	temp 		string//temporary file holding the data received so far
+	file 		*os.File
+	committed 	bool//temporary file was renamed to name
+}
+
+func newUpload(root *os.Root, name string) (*upload, error) {
+	dir, base := path.Split(name)
+	for {
+		temp := fmt.Sprintf("%s.%s.%d%s", dir, base, rand.Uint32(), UPLOAD_SUFFIX)
+		file, err := root.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {//name taken by another upload, try another one
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return &upload{root: root, name: name, temp: temp, file: file}, nil
+	}
+}
+
+//stores the file and replaces name with it once r ends without an error
+func (u *upload) ReadFrom(r io.Reader) (int64, error) {
+	written, err := u.file.ReadFrom(r)
+	if err == nil {
+		err = u.file.Sync()
+	}
+	closeErr := u.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = u.root.Rename(u.temp, u.name)
+	}
+	if err != nil {
+		u.root.Remove(u.temp)
+		return written, err
+	}
+	u.committed = true
+	return written, nil
+}
+
+//discards the data unless the file was stored
+func (u *upload) Close() error {
+	if !u.committed {
+		u.file.Close()
+		u.root.Remove(u.temp)
+	}
+	return u.root.Close()
+}
@@ -0,0 +1,91 @@
+package tftpOctet
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+//-------------------------------------------------------------------------------------------------------
+//Handlers decide what the server does with a request before any transfer starts.
+//A handler either hands back a stream for the file or an error that is sent to the
+//client as the first reply. The server copies between the stream and the network
+//-------------------------------------------------------------------------------------------------------
+
+//read or write request received by the server
+type Request struct {
+	FileName 		string//name of the file requested by the client
+	Mode 			string//transfer mode (octet or netascii)
+	Options 		map[string]string//options requested by the client
+	RemoteAddr 		*net.UDPAddr//address of the client
+	TransferSize 	int64//size the client announced for a write with tsize. -1 if unknown
+}
+
+//serves files clients read from the server
+//ServeRead returns the file to send. Its WriteTo is called once with the transfer as the writer,
+//and the size is sent to clients asking for it when the stream has a Len, Size or Stat method.
+//A stream that is an io.Closer is closed after the transfer
+type ReadHandler interface {
+	ServeRead(r *Request) (io.WriterTo, error)
+}
+
+//serves files clients write to the server
+//ServeWrite returns where to store the file. Its ReadFrom is called once with the transfer as the reader,
+//and fails if the transfer does. The last block is only acknowledged once ReadFrom returned, and an error
+//it returns is sent to the client instead. A stream that is an io.Closer is closed after the transfer
+type WriteHandler interface {
+	ServeWrite(r *Request) (io.ReaderFrom, error)
+}
+
+//lets an ordinary function be used as a ReadHandler
+type ReadHandlerFunc func(r *Request) (io.WriterTo, error)
+
+func (f ReadHandlerFunc) ServeRead(r *Request) (io.WriterTo, error) {
+	return f(r)
+}
+
+//lets an ordinary function be used as a WriteHandler
+type WriteHandlerFunc func(r *Request) (io.ReaderFrom, error)
+
+func (f WriteHandlerFunc) ServeWrite(r *Request) (io.ReaderFrom, error) {
+	return f(r)
+}
+
+//size of a stream returned by a ReadHandler or given to Client.Put
+//only counts what is left to read. -1 if the stream does not know its size
+func streamSize(stream interface{}) int64 {
+	var size int64
+	switch s := stream.(type) {
+		case interface{ Len() int }://bytes.Reader and strings.Reader know what is left
+			return int64(s.Len())
+		case interface{ Size() int64 }:
+			size = s.Size()
+		case interface{ Stat() (os.FileInfo, error) }:
+			info, err := s.Stat()
+			if err != nil || !info.Mode().IsRegular() {
+				return -1
+			}
+			size = info.Size()
+		default:
+			return -1
+	}
+	//a file that was partly read already only sends the rest
+	if seeker, ok := stream.(io.Seeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		size -= offset
+		if size < 0 {
+			size = 0
+		}
+	}
+	return size
+}
+
+//closes a stream returned by a handler once the transfer is over
+func closeStream(stream interface{}) {
+	if closer, ok := stream.(io.Closer); ok {
+		closer.Close()
+	}
+}
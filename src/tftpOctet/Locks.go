@@ -0,0 +1,79 @@
+package tftpOctet
+
+import (
+	"sync"
+)
+
+var (
+	defaultFileLocker = NewFileLocker()//shared by clients that do not bring their own FileLocker
+)
+
+//-------------------------------------------------------------------------------------------------------
+//FileLocker serializes transfers of the same file. Reads of a file can happen concurrently
+//while a write blocks all other transfers of it. Transfers of different files never wait on each other
+//-------------------------------------------------------------------------------------------------------
+
+type FileLocker interface {
+	Lock(name string)//lock name for a write
+	Unlock(name string)
+	RLock(name string)//lock name for a read
+	RUnlock(name string)
+}
+
+//FileLocker with a read/write lock per name
+//locks are dropped again once nobody holds or waits for them
+type fileLocks struct {
+	mutex 	sync.Mutex//guards locks
+	locks 	map[string]*fileLock
+}
+
+type fileLock struct {
+	sync.RWMutex
+	users 	int//transfers holding or waiting for the lock
+}
+
+//creates a FileLocker that can be shared between Clients and Servers
+func NewFileLocker() FileLocker {
+	return &fileLocks{locks: map[string]*fileLock{}}
+}
+
+func (f *fileLocks) Lock(name string) {
+	f.acquire(name).Lock()
+}
+
+func (f *fileLocks) Unlock(name string) {
+	f.release(name).Unlock()
+}
+
+func (f *fileLocks) RLock(name string) {
+	f.acquire(name).RLock()
+}
+
+func (f *fileLocks) RUnlock(name string) {
+	f.release(name).RUnlock()
+}
+
+//finds or creates the lock for name and registers another user of it
+func (f *fileLocks) acquire(name string) *fileLock {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	lock, exists := f.locks[name]
+	if !exists {
+		lock = &fileLock{}
+		f.locks[name] = lock
+	}
+	lock.users++
+	return lock
+}
+
+//unregisters a user of the lock for name, dropping the lock if it was the last one
+func (f *fileLocks) release(name string) *fileLock {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	lock := f.locks[name]
+	lock.users--
+	if lock.users == 0 {
+		delete(f.locks, name)
+	}
+	return lock
+}
@@ -0,0 +1,128 @@
+package tftpOctet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	MEMORY_QUEUE_SIZE = 1024 //packets waiting on a socket of a MemoryNetwork before more are dropped
+	MEMORY_FIRST_PORT = 49152 //first port given to sockets that do not ask for one
+)
+
+//-------------------------------------------------------------------------------------------------------
+//MemoryNetwork is a Transport that hands packets from socket to socket within the process.
+//It behaves like a single host: sockets are told apart by their port alone, and packets to a
+//port nobody listens on are lost. The zero value is an empty network ready to use
+//-------------------------------------------------------------------------------------------------------
+
+type MemoryNetwork struct {
+	Drop 	func(packet []byte, from net.Addr, to net.Addr) bool//optional. Decides whether a packet is lost. Called for one packet at a time
+
+	mutex 	sync.Mutex//guards the fields below
+	conns 	map[int]*memoryConn//open sockets by port
+	next 	int//port tried first for the next socket that does not ask for one
+}
+
+//opens a socket on the port of addr, or on a free port if it is 0
+//the socket reports addr's IP as its own, 127.0.0.1 if it has none
+func (n *MemoryNetwork) ListenPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.conns == nil {
+		n.conns = map[int]*memoryConn{}
+		n.next = MEMORY_FIRST_PORT
+	}
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if addr != nil {
+		if addr.IP != nil && !addr.IP.IsUnspecified() {
+			local.IP = addr.IP
+		}
+		local.Port = addr.Port
+	}
+	if local.Port < 0 || local.Port > 65535 {
+		return nil, fmt.Errorf("Invalid port: %d", local.Port)
+	} else if local.Port == 0 {
+		//hand out ports in turn like the system does, so a port is not reused right after it was closed
+		for i := MEMORY_FIRST_PORT; i <= 65535 && local.Port == 0; i++ {
+			if _, taken := n.conns[n.next]; !taken {
+				local.Port = n.next
+			}
+			n.next++
+			if n.next > 65535 {
+				n.next = MEMORY_FIRST_PORT
+			}
+		}
+		if local.Port == 0 {
+			return nil, errors.New("No free port in memory network")
+		}
+	} else if _, taken := n.conns[local.Port]; taken {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: local, Err: syscall.EADDRINUSE}
+	}
+	conn := &memoryConn{network: n, addr: local, queue: newPacketQueue(MEMORY_QUEUE_SIZE)}
+	n.conns[local.Port] = conn
+	return conn, nil
+}
+
+//socket of a MemoryNetwork
+type memoryConn struct {
+	network 	*MemoryNetwork
+	addr 		*net.UDPAddr
+	queue 		*packetQueue//packets sent to the socket
+}
+
+func (c *memoryConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.queue.read(b)
+}
+
+//delivers a copy of b to the socket listening on the port of addr
+func (c *memoryConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "memory", Source: c.addr, Addr: addr, Err: errors.New("not a UDP address")}
+	}
+	c.network.mutex.Lock()
+	defer c.network.mutex.Unlock()
+	if c.network.conns[c.addr.Port] != c {
+		return 0, net.ErrClosed
+	}
+	dest, exists := c.network.conns[to.Port]
+	if exists && (c.network.Drop == nil || !c.network.Drop(b, c.addr, to)) {
+		dest.queue.push(c.addr, b)
+	}
+	return len(b), nil
+}
+
+//frees the port. Reads waiting on the socket fail with net.ErrClosed
+func (c *memoryConn) Close() error {
+	c.network.mutex.Lock()
+	defer c.network.mutex.Unlock()
+	if c.network.conns[c.addr.Port] != c {
+		return net.ErrClosed
+	}
+	delete(c.network.conns, c.addr.Port)
+	c.queue.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.queue.setReadDeadline(t)
+	return nil
+}
+
+//writes never block, so there is nothing to interrupt
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package tftpOctet
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	//transfer modes
+	MODE_OCTET = "octet" //raw bytes
+	MODE_NETASCII = "netascii" //text with CR LF line endings
+)
+
+//-------------------------------------------------------------------------------------------------------
+//netascii translation (RFC 764). On the wire a line ends with CR LF and a bare CR is sent as CR NUL.
+//Data handed to and from handlers uses plain LF line endings
+//-------------------------------------------------------------------------------------------------------
+
+//checks that the server knows how to transfer files in the requested mode
+//mode names are case insensitive
+func checkMode(mode string) error {
+	switch strings.ToLower(mode) {
+		case MODE_OCTET, MODE_NETASCII:
+			return nil
+	}
+	return fmt.Errorf("Unsupported transfer mode: %s", mode)
+}
+
+func isNetascii(mode string) bool {
+	return strings.EqualFold(mode, MODE_NETASCII)
+}
+
+//netasciiReader encodes data read from a handler before it is sent
+type netasciiReader struct {
+	reader 	io.Reader
+	buffer 	[]byte//data read from the handler
+	out 	[]byte//encoded data
+	next 	int//start of the encoded data not yet returned by Read
+}
+
+func newNetasciiReader(reader io.Reader) *netasciiReader {
+	return &netasciiReader{reader: reader, buffer: make([]byte, BLOCK_SIZE)}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	if n.next == len(n.out) {
+		n.out, n.next = n.out[:0], 0
+		dataLength, err := n.reader.Read(n.buffer)
+		for _, c := range n.buffer[:dataLength] {
+			switch c {
+				case '\n':
+					n.out = append(n.out, '\r', '\n')
+				case '\r':
+					n.out = append(n.out, '\r', 0x0)
+				default:
+					n.out = append(n.out, c)
+			}
+		}
+		if len(n.out) == 0 {
+			return 0, err
+		}
+	}
+	copied := copy(p, n.out[n.next:])
+	n.next += copied
+	return copied, nil
+}
+
+//netasciiWriter decodes received data before it is given to a handler
+type netasciiWriter struct {
+	writer 	io.Writer
+	buffer 	[]byte//decoded data being written
+	cr 		bool//last byte received was a CR, its meaning depends on the next byte
+}
+
+func newNetasciiWriter(writer io.Writer) *netasciiWriter {
+	return &netasciiWriter{writer: writer}
+}
+
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	out := n.buffer[:0]
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+			if c == '\n' {//CR LF is a line ending
+				out = append(out, '\n')
+				continue
+			}
+			//CR NUL is a bare CR. Senders that leave out the NUL still get their CR
+			out = append(out, '\r')
+			if c == 0x0 {
+				continue
+			}
+		}
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	n.buffer = out
+	if len(out) > 0 {
+		_, err := n.writer.Write(out)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//writes a CR that ended the data
+func (n *netasciiWriter) Flush() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.writer.Write([]byte{'\r'})
+	return err
+}
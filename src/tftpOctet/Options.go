@@ -0,0 +1,205 @@
+package tftpOctet
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	OPTION_BLKSIZE = "blksize" //block size (RFC 2348)
+	OPTION_TSIZE = "tsize" //transfer size (RFC 2349)
+	OPTION_TIMEOUT = "timeout" //retransmission timeout in seconds (RFC 2349)
+	OPTION_WINDOWSIZE = "windowsize" //blocks sent before waiting for an ACK (RFC 7440)
+
+	MIN_BLOCK_SIZE = 8 //smallest block size that can be negotiated
+	MAX_BLOCK_SIZE = 65464 //largest block size that can be negotiated
+
+	MIN_TIMEOUT = 1 //shortest timeout in seconds that can be negotiated
+	MAX_TIMEOUT = 255 //longest timeout in seconds that can be negotiated
+
+	MAX_WINDOW_SIZE = 65535 //largest window size that can be negotiated
+	DEFAULT_MAX_WINDOW_SIZE = 64 //largest window size a server agrees to unless configured. Each block in a window is buffered
+
+	DEFAULT_SEND_TIMEOUT = 3*time.Second //sender timeout when none was configured or negotiated
+	DEFAULT_RECEIVE_TIMEOUT = 4*time.Second //receiver waits longer because of latency
+	DEFAULT_RETRIES = 3 //attempts at sending a packet before giving up
+)
+
+//-------------------------------------------------------------------------------------------------------
+//Option negotiation (RFC 2347). Clients append name/value pairs to RRQ and WRQ packets,
+//the server answers with an OACK holding the options it agreed to
+//-------------------------------------------------------------------------------------------------------
+
+//server side of the negotiation
+//returns the subset of requested options the server agrees to. Options the server
+//does not understand are left out, and an empty result means no OACK is sent.
+//size is the size of the file being read, -1 if unknown
+func (s *Server) negotiate(requested map[string]string, size int64, write bool) map[string]string {
+	accepted := map[string]string{}
+	if value, ok := requested[OPTION_BLKSIZE]; ok {
+		blk, err := strconv.Atoi(value)
+		if err == nil && blk >= MIN_BLOCK_SIZE {
+			//server may lower the requested size but never raise it
+			maxSize := MAX_BLOCK_SIZE
+			if s.BlockSize >= MIN_BLOCK_SIZE && s.BlockSize < maxSize {
+				maxSize = s.BlockSize
+			}
+			if blk > maxSize {
+				blk = maxSize
+			}
+			accepted[OPTION_BLKSIZE] = strconv.Itoa(blk)
+		}
+	}
+	if _, ok := requested[OPTION_TSIZE]; ok {
+		if write && transferSize(requested) >= 0 {
+			//client announced the size of its file and the write handler accepted it
+			accepted[OPTION_TSIZE] = requested[OPTION_TSIZE]
+		} else if !write && size >= 0 {
+			//client asked for the size of the file it is reading
+			accepted[OPTION_TSIZE] = strconv.FormatInt(size, 10)
+		}
+	}
+	if value, ok := requested[OPTION_WINDOWSIZE]; ok {
+		win, err := strconv.Atoi(value)
+		if err == nil && win >= 1 {
+			//server may lower the requested window but never raise it
+			maxSize := DEFAULT_MAX_WINDOW_SIZE
+			if s.WindowSize >= 1 && s.WindowSize <= MAX_WINDOW_SIZE {
+				maxSize = s.WindowSize
+			}
+			if win > maxSize {
+				win = maxSize
+			}
+			accepted[OPTION_WINDOWSIZE] = strconv.Itoa(win)
+		}
+	}
+	if value, ok := requested[OPTION_TIMEOUT]; ok {
+		//the server has to use the client's timeout as is or ignore the option
+		if timeoutOption(requested) > 0 {
+			accepted[OPTION_TIMEOUT] = value
+		}
+	}
+	return accepted
+}
+
+//builds the options a client puts in its RRQ or WRQ
+func (c Client) requestOptions() (map[string]string, error) {
+	options := map[string]string{}
+	if c.Rollover > 1 {
+		return nil, fmt.Errorf("Block number rollover must be 0 or 1: %d", c.Rollover)
+	}
+	if c.BlockSize != 0 && c.BlockSize != BLOCK_SIZE {
+		if c.BlockSize < MIN_BLOCK_SIZE || c.BlockSize > MAX_BLOCK_SIZE {
+			return nil, fmt.Errorf("Block size must be between %d and %d: %d", MIN_BLOCK_SIZE, MAX_BLOCK_SIZE, c.BlockSize)
+		}
+		options[OPTION_BLKSIZE] = strconv.Itoa(c.BlockSize)
+	}
+	if c.WindowSize != 0 && c.WindowSize != 1 {
+		if c.WindowSize < 1 || c.WindowSize > MAX_WINDOW_SIZE {
+			return nil, fmt.Errorf("Window size must be between 1 and %d: %d", MAX_WINDOW_SIZE, c.WindowSize)
+		}
+		options[OPTION_WINDOWSIZE] = strconv.Itoa(c.WindowSize)
+	}
+	if c.Timeout < 0 {
+		return nil, fmt.Errorf("Timeout must not be negative: %v", c.Timeout)
+	}
+	err := checkAdaptiveTimeouts(c.MinTimeout, c.MaxTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if c.Timeout > 0 {
+		//the option only holds whole seconds, so round up
+		seconds := int((c.Timeout + time.Second - 1) / time.Second)
+		if seconds > MAX_TIMEOUT {
+			seconds = MAX_TIMEOUT
+		}
+		options[OPTION_TIMEOUT] = strconv.Itoa(seconds)
+	}
+	return options, nil
+}
+
+//client side of the negotiation
+//the server may only acknowledge options the client asked for
+func checkOptionAck(requested map[string]string, acked map[string]string) error {
+	for name, value := range acked {
+		if _, ok := requested[name]; !ok {
+			return fmt.Errorf("Server acknowledged option that was not requested: %s", name)
+		}
+		switch name {
+			case OPTION_BLKSIZE:
+				size, err := strconv.Atoi(value)
+				if err != nil || size < MIN_BLOCK_SIZE || size > blockSize(requested) {
+					return fmt.Errorf("Server acknowledged invalid block size: %s", value)
+				}
+			case OPTION_WINDOWSIZE:
+				size, err := strconv.Atoi(value)
+				if err != nil || size < 1 || size > windowSize(requested) {
+					return fmt.Errorf("Server acknowledged invalid window size: %s", value)
+				}
+			case OPTION_TSIZE:
+				if transferSize(acked) < 0 {
+					return fmt.Errorf("Server acknowledged invalid transfer size: %s", value)
+				}
+			case OPTION_TIMEOUT:
+				if value != requested[OPTION_TIMEOUT] {
+					return fmt.Errorf("Server acknowledged different timeout: %s", value)
+				}
+		}
+	}
+	return nil
+}
+
+//block size to use for a transfer with the given options
+//falls back to the RFC 1350 size when blksize was not negotiated
+func blockSize(options map[string]string) int {
+	size, err := strconv.Atoi(options[OPTION_BLKSIZE])
+	if err != nil || size < MIN_BLOCK_SIZE || size > MAX_BLOCK_SIZE {
+		return BLOCK_SIZE
+	}
+	return size
+}
+
+//number of blocks sent before waiting for an ACK
+//a single block unless windowsize was negotiated
+func windowSize(options map[string]string) int {
+	size, err := strconv.Atoi(options[OPTION_WINDOWSIZE])
+	if err != nil || size < 1 || size > MAX_WINDOW_SIZE {
+		return 1
+	}
+	return size
+}
+
+//size of the file being transferred
+//-1 if the size was not negotiated
+func transferSize(options map[string]string) int64 {
+	size, err := strconv.ParseInt(options[OPTION_TSIZE], 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+//timeout negotiated with the timeout option
+//0 if the option was not negotiated
+func timeoutOption(options map[string]string) time.Duration {
+	seconds, err := strconv.Atoi(options[OPTION_TIMEOUT])
+	if err != nil || seconds < MIN_TIMEOUT || seconds > MAX_TIMEOUT {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+//timeout the server uses for a transfer: the client's choice if it asked for one, the server's otherwise
+func (s *Server) transferTimeout(options map[string]string) time.Duration {
+	if timeout := timeoutOption(options); timeout > 0 {
+		return timeout
+	}
+	return s.Timeout
+}
+
+//whether the server adapts its timeout to a transfer
+//a timeout the client negotiated is used as is
+func (s *Server) adaptiveTimeout(options map[string]string) bool {
+	return s.AdaptiveTimeout && timeoutOption(options) == 0
+}
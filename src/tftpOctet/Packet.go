@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io/fs"
+	"net"
+	"sort"
 	"strings"
 )
 
@@ -14,13 +18,25 @@ const (
 	OPCODE_DATA = uint16(3) //Data 
 	OPCODE_ACK = uint16(4) //Acknowledgement
 	OPCODE_ERROR = uint16(5) //Error
+	OPCODE_OACK = uint16(6) //Option Acknowledgement (RFC 2347)
 
-	BLOCK_SIZE = 512 //max length of datagram
-	MAX_DATAGRAM_SIZE = 516 //max length of packets
+	//error codes for ERROR packets
+	ERROR_UNDEFINED = uint16(0) //Not defined, see error message
+	ERROR_FILE_NOT_FOUND = uint16(1) //File not found
+	ERROR_ACCESS_VIOLATION = uint16(2) //Access violation
+	ERROR_DISK_FULL = uint16(3) //Disk full or allocation exceeded
+	ERROR_ILLEGAL_OPERATION = uint16(4) //Illegal TFTP operation
+	ERROR_UNKNOWN_TID = uint16(5) //Unknown transfer ID
+	ERROR_FILE_EXISTS = uint16(6) //File already exists
+	ERROR_NO_SUCH_USER = uint16(7) //No such user
+	ERROR_OPTION_REFUSED = uint16(8) //Transfer terminated during option negotiation (RFC 2347)
+
+	BLOCK_SIZE = 512 //length of datagram when no block size was negotiated
+	MAX_DATAGRAM_SIZE = 516 //length of packets when no block size was negotiated
 )
 
 //-------------------------------------------------------------------------------------------------------
-//Packet interface generalizes Read Request, Write Request, ACK, Data, and Error types
+//Packet interface generalizes Read Request, Write Request, ACK, Data, Error, and Option ACK types
 //to make it easier to pass packets between clients and server
 //-------------------------------------------------------------------------------------------------------
 
@@ -32,28 +48,33 @@ type Packet interface {
 type RRQ struct {
 	FileName 	string
 	Mode 		string
+	Options 	map[string]string//option name/value pairs (RFC 2347). nil if none were requested
 }
 
-//gets filename and mode in packet
+//gets filename, mode and any options in packet
 //check that packet has filename and mode. Return error if cannot
-func ReadWritePacket(b []byte) (filename string, mode string, err error) {
+func ReadWritePacket(b []byte) (filename string, mode string, options map[string]string, err error) {
 	withoutOP := bytes.NewBuffer(b[2:])
 	filePlusZero, err := withoutOP.ReadString(0x0)
 	if err != nil {
-		return "", "", err
+		return "", "", nil, err
 	}
 	filename = strings.TrimSpace(strings.Trim(filePlusZero, "\x00"))
 	modePlusExtra, err := withoutOP.ReadString(0x0)
 	if err != nil {
-		return "", "", err
+		return "", "", nil, err
+	}
+	mode = strings.TrimSpace(strings.Trim(modePlusExtra, "\x00"))
+	options, err = readOptions(withoutOP)
+	if err != nil {
+		return "", "", nil, err
 	}
-	mode = strings.TrimSpace(modePlusExtra)
-	return filename, mode, nil
+	return filename, mode, options, nil
 }
 
 func (r *RRQ) CheckPacket(b []byte) error{
-	filename, mode, err := ReadWritePacket(b)
-	r.FileName, r.Mode = filename, mode
+	filename, mode, options, err := ReadWritePacket(b)
+	r.FileName, r.Mode, r.Options = filename, mode, options
 	if err != nil {
 		return err
 	}
@@ -61,28 +82,30 @@ func (r *RRQ) CheckPacket(b []byte) error{
 }
 
 //helper function to build both Read and Write Requests
-func packReadWriteRQ(filename string, mode string, opcode uint16) []byte {
+func packReadWriteRQ(filename string, mode string, options map[string]string, opcode uint16) []byte {
 	buffer := new(bytes.Buffer)
 	binary.Write(buffer, binary.BigEndian, opcode)
 	buffer.WriteString(filename)
 	buffer.WriteByte(0x0)
 	buffer.WriteString(mode)
 	buffer.WriteByte(0x0)
+	writeOptions(buffer, options)
 	return buffer.Bytes()
 }
 
 func (r *RRQ) Pack() []byte {
-	return packReadWriteRQ(r.FileName, r.Mode, OPCODE_RRQ)
+	return packReadWriteRQ(r.FileName, r.Mode, r.Options, OPCODE_RRQ)
 }
 
 type WRQ struct {
 	FileName 	string
 	Mode 		string
+	Options 	map[string]string//option name/value pairs (RFC 2347). nil if none were requested
 }
 
 func (w *WRQ) CheckPacket(b []byte) error {
-	filename, mode, err := ReadWritePacket(b)
-	w.FileName, w.Mode = filename, mode
+	filename, mode, options, err := ReadWritePacket(b)
+	w.FileName, w.Mode, w.Options = filename, mode, options
 	if err != nil {
 		return err
 	}
@@ -90,7 +113,7 @@ func (w *WRQ) CheckPacket(b []byte) error {
 }
 
 func (w *WRQ) Pack() []byte {
-	return packReadWriteRQ(w.FileName, w.Mode, OPCODE_WRQ)
+	return packReadWriteRQ(w.FileName, w.Mode, w.Options, OPCODE_WRQ)
 }
 
 type DATA struct {
@@ -115,6 +138,30 @@ func (d *DATA) Pack() []byte {
 	return buffer.Bytes()
 }
 
+//block number sent on the wire for the given block of a transfer
+//counting starts at 1 with the first block of data. After 65535 the
+//number wraps around to rollover (0 or 1)
+func blockNumber(block int64, rollover uint16) uint16 {
+	if rollover == 1 && block > 0 {
+		return uint16((block-1) % 65535 + 1)
+	}
+	return uint16(block)
+}
+
+//number of blocks num comes after block
+//used to place the 16 bit block numbers of incoming packets in the transfer
+func blockDistance(block int64, num uint16, rollover uint16) int64 {
+	if rollover == 1 {
+		//block numbers cycle through 1-65535, 0 is only used before the first block
+		if num == 0 {
+			return 0
+		}
+		from := int64(blockNumber(block, rollover)) % 65535
+		return (int64(num) - from + 65535) % 65535
+	}
+	return int64(num - blockNumber(block, rollover))
+}
+
 
 type ACK struct {
 	BlockNum uint16
@@ -151,7 +198,7 @@ func (e *ERROR) CheckPacket(b []byte) error {
 	if err != nil {
 		return err
 	}
-	e.ErrMsg = strings.TrimSpace(endString)
+	e.ErrMsg = strings.TrimSpace(strings.Trim(endString, "\x00"))
 	return nil
 }
 
@@ -164,9 +211,126 @@ func (e *ERROR) Pack() []byte {
 	return buffer.Bytes()
 }
 
+//TFTPError is an error carried by an ERROR packet
+//handlers return one to choose the code sent to the other side, and clients
+//get one back when the server answered with an ERROR packet
+type TFTPError struct {
+	Code 	uint16
+	Message string
+}
+
+func (e *TFTPError) Error() string {
+	return fmt.Sprintf("TFTP error %d: %s", e.Code, e.Message)
+}
+
+//builds the ERROR packet that reports err to the other side
+//errCode is used unless err is a TFTPError that carries its own code
+//or a file system error with a matching code
+func errorPacket(err error, errCode uint16) *ERROR {
+	var tftpErr *TFTPError
+	switch {
+		case errors.As(err, &tftpErr):
+			return &ERROR{tftpErr.Code, tftpErr.Message}
+		case errors.Is(err, fs.ErrNotExist):
+			errCode = ERROR_FILE_NOT_FOUND
+		case errors.Is(err, fs.ErrPermission):
+			errCode = ERROR_ACCESS_VIOLATION
+		case errors.Is(err, fs.ErrExist):
+			errCode = ERROR_FILE_EXISTS
+	}
+	return &ERROR{errCode, err.Error()}
+}
+
+//whether a packet came from the other side of a transfer
+//the address and port of the other side make up its transfer ID (TID)
+func sameAddr(a net.Addr, b net.Addr) bool {
+	udpA, okA := a.(*net.UDPAddr)
+	udpB, okB := b.(*net.UDPAddr)
+	if okA && okB {
+		return udpA.Port == udpB.Port && udpA.IP.Equal(udpB.IP)
+	}
+	return a.String() == b.String()
+}
+
+//answers a packet that did not come from the other side of a transfer
+//the packet is otherwise ignored so the transfer goes on undisturbed
+func rejectUnknownTID(conn net.PacketConn, addr net.Addr) {
+	errPacket := ERROR{ERROR_UNKNOWN_TID, "Unknown transfer ID"}
+	conn.WriteTo(errPacket.Pack(), addr)
+}
+
+//Option Acknowledgement sent by the server in place of ACK 0 or DATA 1
+//to confirm the options it agreed to
+type OACK struct {
+	Options map[string]string
+}
+
+func (o *OACK) CheckPacket(b []byte) error {
+	if len(b) < 2 {
+		return fmt.Errorf("Invalid OACK packet (length = %d)", len(b))
+	}
+	options, err := readOptions(bytes.NewBuffer(b[2:]))
+	if err != nil {
+		return err
+	}
+	o.Options = options
+	return nil
+}
+
+func (o *OACK) Pack() []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, OPCODE_OACK)
+	writeOptions(buffer, o.Options)
+	return buffer.Bytes()
+}
+
+//reads NUL terminated option name/value pairs until the end of the packet
+//option names are case insensitive so they are stored in lower case
+func readOptions(buffer *bytes.Buffer) (map[string]string, error) {
+	var options map[string]string
+	for buffer.Len() > 0 {
+		namePlusZero, err := buffer.ReadString(0x0)
+		if err != nil {
+			return nil, fmt.Errorf("Option name not terminated: %v", err)
+		}
+		name := strings.ToLower(strings.Trim(namePlusZero, "\x00"))
+		if name == "" {//some clients pad requests with extra zeros
+			continue
+		}
+		valuePlusZero, err := buffer.ReadString(0x0)
+		if err != nil {
+			return nil, fmt.Errorf("Option %s has no value: %v", name, err)
+		}
+		if options == nil {
+			options = map[string]string{}
+		}
+		options[name] = strings.Trim(valuePlusZero, "\x00")
+	}
+	return options, nil
+}
+
+//writes options as NUL terminated name/value pairs
+//names are sorted so that packets are built the same way every time
+func writeOptions(buffer *bytes.Buffer, options map[string]string) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buffer.WriteString(name)
+		buffer.WriteByte(0x0)
+		buffer.WriteString(options[name])
+		buffer.WriteByte(0x0)
+	}
+}
+
 //function called before CheckPacket to identify what kind of packet byte slice is
 func UnPack(buffer []byte) (Packet, error) {
 	var packet Packet
+	if len(buffer) < 2 {
+		return nil, fmt.Errorf("Invalid packet (length = %d)", len(buffer))
+	}
 	opcode := binary.BigEndian.Uint16(buffer)
 	switch opcode {
 		case OPCODE_RRQ: 
@@ -179,6 +343,8 @@ func UnPack(buffer []byte) (Packet, error) {
 			packet = &DATA{}
 		case OPCODE_ERROR:
 			packet = &ERROR{}
+		case OPCODE_OACK:
+			packet = &OACK{}
 		default:
 			return nil, fmt.Errorf("not valid opcode: %d", opcode)
 	}
@@ -0,0 +1,81 @@
+package tftpOctet
+
+import (
+	"fmt"
+)
+
+//which write requests a server accepts
+type WritePolicy int
+
+const (
+	WRITE_ANY = WritePolicy(iota) //files may be created and replaced (default)
+	WRITE_DENY //all writes are refused
+	WRITE_CREATE //only new files may be written, existing ones are never replaced
+	WRITE_REPLACE //only existing files may be replaced, no new files are created
+)
+
+//-------------------------------------------------------------------------------------------------------
+//Write policies are enforced by the server before a write request reaches the WriteHandler,
+//so a refused write is answered with an ERROR right away. WRITE_CREATE and WRITE_REPLACE need a
+//WriteHandler that is a FileChecker to tell whether a file exists
+//-------------------------------------------------------------------------------------------------------
+
+//implemented by handlers that can tell whether a file exists
+type FileChecker interface {
+	FileExists(filename string) (bool, error)
+}
+
+//checks that the server's WritePolicy can be enforced
+func (s *Server) checkWritePolicy() error {
+	switch s.WritePolicy {
+		case WRITE_ANY, WRITE_DENY:
+			return nil
+		case WRITE_CREATE, WRITE_REPLACE:
+			if _, ok := s.WriteHandler.(FileChecker); !ok {
+				return fmt.Errorf("Write policy %d needs a WriteHandler that is a FileChecker", s.WritePolicy)
+			}
+			return nil
+	}
+	return fmt.Errorf("Unknown write policy: %d", s.WritePolicy)
+}
+
+//refuses a write the server's WritePolicy does not allow
+//under WRITE_CREATE and WRITE_REPLACE the file stays reserved until release is called, so that a second
+//write of it is refused right away instead of passing the check before the first one stored the file
+func (s *Server) allowWrite(filename string) (release func(), err error) {
+	if s.WritePolicy == WRITE_DENY {
+		return nil, &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("Writes are not allowed: %s", filename)}
+	}
+	if s.WritePolicy != WRITE_CREATE && s.WritePolicy != WRITE_REPLACE {
+		return func() {}, nil
+	}
+	s.mutex.Lock()
+	if s.writing[filename] {
+		s.mutex.Unlock()
+		if s.WritePolicy == WRITE_CREATE {
+			return nil, &TFTPError{ERROR_FILE_EXISTS, fmt.Sprintf("File already exists: %s", filename)}
+		}
+		return nil, &TFTPError{ERROR_ACCESS_VIOLATION, fmt.Sprintf("File is being written by another client: %s", filename)}
+	}
+	if s.writing == nil {
+		s.writing = map[string]bool{}
+	}
+	s.writing[filename] = true
+	s.mutex.Unlock()
+	release = func() {
+		s.mutex.Lock()
+		delete(s.writing, filename)
+		s.mutex.Unlock()
+	}
+	exists, err := s.WriteHandler.(FileChecker).FileExists(filename)
+	if err == nil && exists && s.WritePolicy == WRITE_CREATE {
+		err = &TFTPError{ERROR_FILE_EXISTS, fmt.Sprintf("File already exists: %s", filename)}
+	} else if err == nil && !exists && s.WritePolicy == WRITE_REPLACE {
+		err = &TFTPError{ERROR_FILE_NOT_FOUND, fmt.Sprintf("File not found: %s", filename)}
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
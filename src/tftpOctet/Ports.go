@@ -0,0 +1,61 @@
+package tftpOctet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"syscall"
+)
+
+var (
+	ERR_NO_FREE_PORT = errors.New("No free port for transfer")
+)
+
+//-------------------------------------------------------------------------------------------------------
+//Every transfer runs on a socket of its own. Servers and clients can keep those sockets
+//within a range of ports so that firewalls only need to let that range through
+//-------------------------------------------------------------------------------------------------------
+
+//range of UDP ports from First to Last, both included
+//the zero value lets the system pick any free port
+type PortRange struct {
+	First 	int
+	Last 	int
+}
+
+//checks that the range only holds valid ports
+func (p PortRange) check() error {
+	if p == (PortRange{}) {
+		return nil
+	}
+	if p.First < 1 || p.Last > 65535 || p.First > p.Last {
+		return fmt.Errorf("Invalid port range: %d-%d", p.First, p.Last)
+	}
+	return nil
+}
+
+//opens a socket for a transfer on ip and a free port of the range
+//ports are tried from a random one onwards so that transfers do not all compete for the first ports
+func (p PortRange) listen(transport Transport, ip net.IP) (net.PacketConn, error) {
+	err := p.check()
+	if err != nil {
+		return nil, err
+	}
+	if p == (PortRange{}) {
+		return transport.ListenPacket(&net.UDPAddr{IP: ip})
+	}
+	size := p.Last - p.First + 1
+	start := rand.IntN(size)
+	for i := 0; i < size; i++ {
+		port := p.First + (start+i)%size
+		conn, err := transport.ListenPacket(&net.UDPAddr{IP: ip, Port: port})
+		if errors.Is(err, syscall.EADDRINUSE) {//port taken, try the next one
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("%w: all ports from %d to %d are in use", ERR_NO_FREE_PORT, p.First, p.Last)
+}
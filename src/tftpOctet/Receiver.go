@@ -1,6 +1,7 @@
 package tftpOctet
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"io"
@@ -10,7 +11,6 @@ import (
 )
 
 var (
-	ERROR_UNDEFINED = uint16(0)
 	ERR_RECEIVE_TIMEOUT = errors.New("Receive Timeout")//variable to identify error type in testing
 )
 
@@ -20,100 +20,341 @@ var (
 //-------------------------------------------------------------------------------------------------------
 
 type receiver struct {
-	RemoteAddr *net.UDPAddr//UDP Addr to communicate with other side
-	UDPConn    *net.UDPConn//access UDP port
+	RemoteAddr net.Addr//address to communicate with other side
+	Conn       net.PacketConn//socket the transfer runs on
 	Writer     *io.PipeWriter//Pipe to give client data
 	FileName   string//name of file for which receiving data 
 	Mode       string//transfer type (octet)
-	Log        *log.Logger//log to store important events
+	Options    map[string]string//options requested by the client or accepted by the server
+	Timeout    time.Duration//time to wait for data before resending the last ACK. 0 uses DEFAULT_RECEIVE_TIMEOUT
+	Retries    int//attempts at sending each ACK. 0 uses DEFAULT_RETRIES
+	Adaptive   bool//adapt the timeout to the round trip time, starting from Timeout
+	MinTimeout time.Duration//bounds of adaptive timeouts. 0 uses the defaults
+	MaxTimeout time.Duration
+	Rollover   uint16//block number that follows 65535 (0 or 1)
+	Log        *log.Logger//log to store important events. nil logs nothing
+	Negotiated func(options map[string]string) error//optional. Called on the client once the server answered its options, an error aborts the transfer
+	Finish     func() error//optional. Called once all of the file was written, before the last block is acknowledged. An error is sent instead of the ACK
+	ctx        context.Context//cancels the transfer
+	timer      *retransmitTimer//timeout of the wait for the next block
+	lastAck    *ACK//acknowledges the last block once the file was received
 }
 
 //initial function call
-//makes continuous calls to receiveBlock until last block of data has been received
-func (r *receiver) run(serverMode bool) error {
+//receives blocks until last block of data has been received or ctx is done
+func (r *receiver) run(ctx context.Context, serverMode bool) error {
+	r.ctx = ctx
+	r.timer = newRetransmitTimer(r.timeout(), r.retries(), r.Adaptive, r.MinTimeout, r.MaxTimeout)
+	//interrupt any wait for a packet or for the handler as soon as ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		r.Conn.SetReadDeadline(time.Now())
+		r.Writer.CloseWithError(ctx.Err())
+	})
+	defer stop()
 
-	var blockNum = uint16(1)
 	var buffer []byte
-	buffer = make([]byte, MAX_DATAGRAM_SIZE)
-	firstBlock := true
+	//a client does not know yet whether the server accepts its block size
+	//so make room for whichever is larger
+	size := blockSize(r.Options)
+	if size < BLOCK_SIZE {
+		size = BLOCK_SIZE
+	}
+	buffer = make([]byte, size+4)
 
-	for {
-		last, err := r.receiveBlock(buffer, blockNum, firstBlock && !serverMode)
-		if err != nil {
-			if r.Log != nil {
-				r.Log.Printf("Error receiving block %d: %v", blockNum, err)
-			}
-			r.Writer.CloseWithError(err)
-			return err
-		}
-		firstBlock = false
-		if last {
-			break
-		}
-		blockNum++
+	var request Packet
+	if !serverMode {//client is sending a read request
+		request = &RRQ{r.FileName, r.Mode, r.Options}
+	} else if len(r.Options) > 0 {//server confirms negotiated options instead of ACK 0
+		request = &OACK{r.Options}
+	} else {//server is ready to receive data
+		request = &ACK{0}
+	}
+	var sink io.Writer = r.Writer
+	if isNetascii(r.Mode) {
+		sink = newNetasciiWriter(r.Writer)
+	}
+	err := r.receiveBlocks(sink, buffer, request, !serverMode)
+	if err != nil && ctx.Err() != nil {
+		err = r.cancel()
+	}
+	if err != nil {
+		r.logf("Error receiving %s: %v", r.FileName, err)
+		r.Writer.CloseWithError(err)
+		return err
 	}
 	defer r.Writer.Close()
 	//terminate receiver
 	return nil
 }
 
-//helper function that is responsibly for sending request/ACK 
-//and handles the block of data coming in from UDP port
-func (r *receiver) receiveBlock(b []byte, blockNum uint16, firstBlockAndClient bool) (last bool, err error) {
-	for i := 0; i < 3; i++ {
-		if firstBlockAndClient {//client is sending a read request 
-			readRequestPacket := RRQ{r.FileName, r.Mode}
-			r.UDPConn.WriteToUDP(readRequestPacket.Pack(), r.RemoteAddr)
-			r.Log.Printf("Read Request sent (%s, %d)", r.FileName, r.Mode)
-		} else {//client or server is receiving data
-			ackPacket := ACK{blockNum-1}
-			r.UDPConn.WriteToUDP(ackPacket.Pack(), r.RemoteAddr)
-			r.Log.Printf("ACK #%d sent", blockNum-1)
-		}
+//helper function that is responsibly for sending request/ACKs 
+//and handles the blocks of data coming in from UDP port.
+//blocks are acknowledged once a whole window (RFC 7440) has arrived in order
+func (r *receiver) receiveBlocks(sink io.Writer, b []byte, request Packet, client bool) error {
+	var received int64//last block received in order
+	nudged := int64(-1)//last block re-acknowledged because of lost or repeated packets
+	sinceAck := 0//blocks received since the last ACK was sent
+	size, window := blockSize(r.Options), windowSize(r.Options)
+	negotiating := client//client has not heard back from the server yet
 
-		//give receiver a longer timeout because of latency
-		setDeadlineErr := r.UDPConn.SetReadDeadline(time.Now().Add(4*time.Second))
-		if setDeadlineErr != nil {
-			return false, fmt.Errorf("Could not set up timeout: %v", setDeadlineErr)
-		}
-		for {
-			dataLength, remoteAddr, readErr := r.UDPConn.ReadFromUDP(b)
-			if netErr, clear := readErr.(net.Error); clear && netErr.Timeout() {
-				//timeout occurred
-				//package might have been lost. resend
-				break
-			} else if readErr != nil {
-				return false, fmt.Errorf("Error reading UDP packet: %v", err)
+	r.sendRequest(request)
+	r.timer.sent(true)
+	setDeadlineErr := r.setTimeout()
+	if setDeadlineErr != nil {
+		return setDeadlineErr
+	}
+	for {
+		dataLength, remoteAddr, readErr := r.Conn.ReadFrom(b)
+		if netErr, clear := readErr.(net.Error); clear && netErr.Timeout() {
+			//timeout occurred
+			//package might have been lost. resend unless the transfer was cancelled
+			if r.ctx.Err() != nil {
+				return r.ctx.Err()
 			}
-			packet, err := UnPack(b[:dataLength])
-			if err != nil {//bad package. listen for another one
-				continue
+			if r.timer.expired() {
+				return ERR_RECEIVE_TIMEOUT
 			}
-			switch p := packet.(type) {
-				case *DATA:
-					r.Log.Printf("Receiver received Data #%d (%d bytes)", p.BlockNum, len(p.Data))
-					if blockNum == p.BlockNum {
-						if firstBlockAndClient {
-							r.RemoteAddr = remoteAddr
-						}
-						_, err := r.Writer.Write(p.Data)
-						if err == nil {
-							ackPacket := ACK{blockNum}
-							r.UDPConn.WriteToUDP(ackPacket.Pack(), r.RemoteAddr)
-							r.Log.Printf("ACK #%d sent", blockNum)
-							return len(p.Data) < BLOCK_SIZE, nil
-						} else {
-							r.Log.Printf("Error unpacking packet #%d", p.BlockNum)
-							errPacket := ERROR{ERROR_UNDEFINED, err.Error()}
-							r.UDPConn.WriteToUDP(errPacket.Pack(), r.RemoteAddr)
-							return false, fmt.Errorf("Failed to Save into Memory: %v", err)
+			r.sendRequest(request)
+			sinceAck = 0
+			setDeadlineErr = r.setTimeout()
+			if setDeadlineErr != nil {
+				return setDeadlineErr
+			}
+			continue
+		} else if readErr != nil {
+			return fmt.Errorf("Error reading UDP packet: %v", readErr)
+		} else if !negotiating && !sameAddr(remoteAddr, r.RemoteAddr) {
+			//a client learns the server's transfer ID from its first answer, from then on only the server is listened to
+			rejectUnknownTID(r.Conn, remoteAddr)
+			continue
+		}
+		packet, err := UnPack(b[:dataLength])
+		if err != nil {//bad package. listen for another one
+			continue
+		}
+		switch p := packet.(type) {
+			case *OACK:
+				if !negotiating {
+					continue
+				}
+				r.logf("Receiver received OACK %v", p.Options)
+				r.timer.answered()
+				r.RemoteAddr = remoteAddr
+				err := checkOptionAck(r.Options, p.Options)
+				if err != nil {
+					errPacket := ERROR{ERROR_OPTION_REFUSED, err.Error()}
+					r.Conn.WriteTo(errPacket.Pack(), r.RemoteAddr)
+					return err
+				}
+				r.Options = p.Options
+				err = r.negotiated()
+				if err != nil {
+					return err
+				}
+				negotiating = false
+				size, window = blockSize(r.Options), windowSize(r.Options)
+				//acknowledge the OACK with ACK 0. Resend that instead of the RRQ from now on
+				request = &ACK{0}
+				r.sendRequest(request)
+				r.timer.sent(true)
+				setDeadlineErr = r.setTimeout()
+				if setDeadlineErr != nil {
+					return setDeadlineErr
+				}
+			case *DATA:
+				r.logf("Receiver received Data #%d (%d bytes)", p.BlockNum, len(p.Data))
+				if negotiating {
+					if p.BlockNum != 1 {
+						continue
+					}
+					//server ignored any options that were requested
+					r.RemoteAddr = remoteAddr
+					r.Options = nil
+					err := r.negotiated()
+					if err != nil {
+						return err
+					}
+					negotiating = false
+					size, window = blockSize(r.Options), windowSize(r.Options)
+				}
+				distance := blockDistance(received, p.BlockNum, r.Rollover)
+				if distance == 1 {//next block in order
+					var err error
+					if len(p.Data) > 0 {//an empty last block has nothing to hand over
+						_, err = sink.Write(p.Data)
+					}
+					if err != nil && r.ctx.Err() != nil {
+						return r.ctx.Err()
+					} else if err != nil {
+						r.logf("Error unpacking packet #%d", p.BlockNum)
+						errPacket := errorPacket(err, ERROR_UNDEFINED)
+						r.Conn.WriteTo(errPacket.Pack(), r.RemoteAddr)
+						return fmt.Errorf("Failed to Save into Memory: %w", err)
+					}
+					received++
+					sinceAck++
+					r.timer.answered()
+					last := len(p.Data) < size
+					if last {
+						//only acknowledge the file once it has been stored
+						err := r.finish(sink)
+						if err != nil {
+							errPacket := errorPacket(err, ERROR_UNDEFINED)
+							r.Conn.WriteTo(errPacket.Pack(), r.RemoteAddr)
+							return fmt.Errorf("Failed to Save into Memory: %w", err)
 						}
 					}
-				case *ERROR:
-					return false, fmt.Errorf("Transmission error %d: %s", p.ErrCode, p.ErrMsg)
-			}
+					request = &ACK{blockNumber(received, r.Rollover)}
+					if last || sinceAck >= window {
+						r.sendRequest(request)
+						r.timer.sent(true)
+						sinceAck = 0
+					}
+					if last {
+						r.lastAck = request.(*ACK)
+						return nil
+					}
+					setDeadlineErr = r.setTimeout()
+					if setDeadlineErr != nil {
+						return setDeadlineErr
+					}
+				} else if nudged != received {
+					//a block was skipped or repeated. Tell the sender once where to continue from
+					//instead of answering every packet of the window or every late duplicate
+					r.sendRequest(request)
+					r.timer.sent(false)
+					nudged = received
+					sinceAck = 0
+				}
+			case *ERROR:
+				return &TFTPError{p.ErrCode, p.ErrMsg}
+		}
+	}
+}
+
+//called by the server once all of a file was received. The last ACK may get lost, so the
+//transfer stays open for two timeouts and acknowledges every repeat of the last block again.
+//Otherwise the client would be told a write failed that was stored. Ends early once ctx is done
+func (r *receiver) dally(ctx context.Context) {
+	//the transfer is over, so ctx no longer interrupts reads by itself
+	stop := context.AfterFunc(ctx, func() {
+		r.Conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	b := make([]byte, blockSize(r.Options)+4)
+	//every repeat means the client missed the ACK again, so it gets another timeout to resend.
+	//A client waiting the same timeout resends just as one timeout runs out, so wait for two
+	wait := 2*r.timer.initial
+	deadline := time.Now().Add(wait)
+	for ctx.Err() == nil {
+		if r.Conn.SetReadDeadline(deadline) != nil {
+			return
+		}
+		dataLength, remoteAddr, readErr := r.Conn.ReadFrom(b)
+		if readErr != nil {//sender got the ACK, or the transfer was closed
+			return
+		} else if !sameAddr(remoteAddr, r.RemoteAddr) {
+			rejectUnknownTID(r.Conn, remoteAddr)
+			continue
+		}
+		packet, err := UnPack(b[:dataLength])
+		if err != nil {
+			continue
+		}
+		switch p := packet.(type) {
+			case *DATA:
+				if p.BlockNum == r.lastAck.BlockNum {
+					r.sendRequest(r.lastAck)
+					deadline = time.Now().Add(wait)
+				}
+			case *ERROR:
+				return
+		}
+	}
+}
+
+//called once the last block was written to sink
+//writes out what netascii decoding held back and hands over to Finish
+func (r *receiver) finish(sink io.Writer) error {
+	if netascii, ok := sink.(*netasciiWriter); ok {
+		err := netascii.Flush()
+		if err != nil {
+			return err
 		}
 	}
-	return false, ERR_RECEIVE_TIMEOUT
-} 
+	if r.Finish != nil {
+		return r.Finish()
+	}
+	return nil
+}
+
+//sends the packet that asks the other side for the next data
+func (r *receiver) sendRequest(request Packet) {
+	r.Conn.WriteTo(request.Pack(), r.RemoteAddr)
+	switch p := request.(type) {
+		case *RRQ:
+			r.logf("Read Request sent (%s, %s)", p.FileName, p.Mode)
+		case *OACK:
+			r.logf("OACK sent %v", p.Options)
+		case *ACK:
+			r.logf("ACK #%d sent", p.BlockNum)
+	}
+}
+
+//tells the other side the transfer was cancelled
+func (r *receiver) cancel() error {
+	errPacket := ERROR{ERROR_UNDEFINED, "Transfer cancelled"}
+	r.Conn.WriteTo(errPacket.Pack(), r.RemoteAddr)
+	return r.ctx.Err()
+}
+
+//hands the options the server agreed to over to Negotiated
+//the server is told with an ERROR if the client does not want to continue
+func (r *receiver) negotiated() error {
+	if r.Negotiated == nil {
+		return nil
+	}
+	err := r.Negotiated(r.Options)
+	if err != nil {
+		errPacket := errorPacket(err, ERROR_UNDEFINED)
+		r.Conn.WriteTo(errPacket.Pack(), r.RemoteAddr)
+	}
+	return err
+}
+
+//prints to Log unless there is none
+func (r *receiver) logf(format string, v ...interface{}) {
+	if r.Log != nil {
+		r.Log.Printf(format, v...)
+	}
+}
+
+//starts waiting for the next packet
+//fails once the transfer is cancelled so that no wait outlives ctx
+func (r *receiver) setTimeout() error {
+	err := r.Conn.SetReadDeadline(time.Now().Add(r.timer.timeout()))
+	if err != nil {
+		return fmt.Errorf("Could not set up timeout: %v", err)
+	}
+	return r.ctx.Err()
+}
+
+//time to wait for the next block, or the first guess at it if it adapts
+func (r *receiver) timeout() time.Duration {
+	//the other side only resends after the timeout option, which holds whole seconds
+	if negotiated := timeoutOption(r.Options); negotiated > r.Timeout {
+		return negotiated
+	}
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DEFAULT_RECEIVE_TIMEOUT
+}
 
+//number of times each ACK is sent before giving up
+func (r *receiver) retries() int {
+	if r.Retries > 0 {
+		return r.Retries
+	}
+	return DEFAULT_RETRIES
+}
@@ -0,0 +1,132 @@
+package tftpOctet
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_MIN_ADAPTIVE_TIMEOUT = 10*time.Millisecond //shortest adaptive timeout unless configured
+	DEFAULT_MAX_ADAPTIVE_TIMEOUT = 60*time.Second //longest adaptive timeout unless configured
+)
+
+//-------------------------------------------------------------------------------------------------------
+//Retransmission timeouts. By default a transfer waits the same fixed time before every resend.
+//Adaptive transfers instead measure how long the other side takes to answer (RFC 6298):
+//the timeout follows the smoothed round trip time, doubles after every resend, and answers to
+//resent packets are never measured because they could belong to any copy (Karn's algorithm)
+//-------------------------------------------------------------------------------------------------------
+
+//timeout of a single transfer
+type retransmitTimer struct {
+	initial 	time.Duration//configured or negotiated timeout. The first guess of adaptive transfers
+	retries 	int//timeouts in a row before the transfer fails
+	adaptive 	bool
+	min 		time.Duration//bounds of adaptive timeouts
+	max 		time.Duration
+
+	wait 		time.Duration//current timeout
+	measured 	bool//srtt and rttvar hold at least one sample
+	srtt 		time.Duration//smoothed round trip time
+	rttvar 		time.Duration//variation of the round trip time
+	sentAt 		time.Time//when the packet being timed was sent. Zero if none is
+	attempts 	int//timeouts since the other side last answered
+	waited 		time.Duration//time spent on those timeouts
+}
+
+func newRetransmitTimer(initial time.Duration, retries int, adaptive bool, min time.Duration, max time.Duration) *retransmitTimer {
+	if min <= 0 {
+		min = DEFAULT_MIN_ADAPTIVE_TIMEOUT
+	}
+	if max <= 0 {
+		max = DEFAULT_MAX_ADAPTIVE_TIMEOUT
+	}
+	t := &retransmitTimer{initial: initial, retries: retries, adaptive: adaptive, min: min, max: max, wait: initial}
+	if adaptive {
+		t.wait = t.clamp(initial)
+	}
+	return t
+}
+
+//time to wait for the answer to the last packet sent
+func (t *retransmitTimer) timeout() time.Duration {
+	return t.wait
+}
+
+//a packet that expects an answer was sent. Only packets sent for the first time are timed
+func (t *retransmitTimer) sent(fresh bool) {
+	if fresh {
+		t.sentAt = time.Now()
+	} else {
+		t.sentAt = time.Time{}
+	}
+}
+
+//the other side answered, so the transfer moves on
+//the round trip time is updated if the packet it answered was timed
+func (t *retransmitTimer) answered() {
+	t.attempts, t.waited = 0, 0
+	if t.sentAt.IsZero() {
+		return
+	}
+	sample := time.Since(t.sentAt)
+	t.sentAt = time.Time{}
+	if !t.adaptive {
+		return
+	}
+	if !t.measured {
+		t.srtt, t.rttvar = sample, sample/2
+		t.measured = true
+	} else {
+		diff := t.srtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		t.rttvar = (3*t.rttvar + diff) / 4
+		t.srtt = (7*t.srtt + sample) / 8
+	}
+	t.wait = t.clamp(t.srtt + 4*t.rttvar)
+}
+
+//no answer came in time and the last packet is about to be resent
+//returns true once the transfer should give up instead. Adaptive timeouts are shorter,
+//so they keep trying until as much time passed as the fixed timeouts would have taken
+func (t *retransmitTimer) expired() bool {
+	t.attempts++
+	t.waited += t.wait
+	t.sentAt = time.Time{}
+	if t.adaptive {
+		t.wait = t.clamp(2*t.wait)
+	}
+	if t.attempts < t.retries {
+		return false
+	}
+	return !t.adaptive || t.waited >= time.Duration(t.retries)*t.initial
+}
+
+func (t *retransmitTimer) clamp(wait time.Duration) time.Duration {
+	if wait > t.max {
+		wait = t.max
+	}
+	if wait < t.min {
+		wait = t.min
+	}
+	return wait
+}
+
+//checks the bounds of adaptive timeouts
+func checkAdaptiveTimeouts(min time.Duration, max time.Duration) error {
+	if min < 0 || max < 0 {
+		return fmt.Errorf("Timeouts must not be negative: %v, %v", min, max)
+	}
+	if min == 0 {
+		min = DEFAULT_MIN_ADAPTIVE_TIMEOUT
+	}
+	if max == 0 {
+		max = DEFAULT_MAX_ADAPTIVE_TIMEOUT
+	}
+	if min > max {
+		return fmt.Errorf("Shortest timeout %v is longer than the longest %v", min, max)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package tftpOctet
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"io"
@@ -11,6 +12,7 @@ import (
 
 var (
 	ERR_SEND_TIMEOUT = errors.New("Send Timeout")
+	errTimedOut = errors.New("Timed out waiting for packet")//a single attempt timed out, the packet is resent
 )
 
 //-------------------------------------------------------------------------------------------------------
@@ -19,87 +21,200 @@ var (
 //-------------------------------------------------------------------------------------------------------
 
 type sender struct {
-	RemoteAddr *net.UDPAddr//UDP Addr to communicate with other side
-	UDPConn    *net.UDPConn//access UDP port
+	RemoteAddr net.Addr//address to communicate with other side
+	Conn       net.PacketConn//socket the transfer runs on
 	Reader     *io.PipeReader//Pipe to get data from sender
 	FileName   string//name of file for which receiving data 
 	Mode       string//transfer type (octet)
-	Log        *log.Logger//log to store important events
+	Options    map[string]string//options requested by the client or accepted by the server
+	Timeout    time.Duration//time to wait for an ACK before resending. 0 uses DEFAULT_SEND_TIMEOUT
+	Retries    int//attempts at sending each packet. 0 uses DEFAULT_RETRIES
+	Adaptive   bool//adapt the timeout to the round trip time, starting from Timeout
+	MinTimeout time.Duration//bounds of adaptive timeouts. 0 uses the defaults
+	MaxTimeout time.Duration
+	Rollover   uint16//block number that follows 65535 (0 or 1)
+	Log        *log.Logger//log to store important events. nil logs nothing
+	ctx        context.Context//cancels the transfer
+	timer      *retransmitTimer//timeout of the packet waiting for an ACK
 }
 
 //initial function call
-//sends initial write request if client or immediately starts sending data packets
-func (s *sender) run(serverMode bool) {
-	var buffer, dataGram []byte
-	buffer = make([]byte, BLOCK_SIZE)
+//sends initial write request if client or immediately starts sending data packets.
+//Stops early once ctx is done
+func (s *sender) run(ctx context.Context, serverMode bool) (err error) {
+	s.ctx = ctx
+	s.timer = newRetransmitTimer(s.timeout(), s.retries(), s.Adaptive, s.MinTimeout, s.MaxTimeout)
+	//interrupt any wait for a packet or for the handler as soon as ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		s.Conn.SetReadDeadline(time.Now())
+		s.Reader.CloseWithError(ctx.Err())
+	})
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = s.cancel()
+		}
+	}()
+	var dataGram []byte
 	dataGram = make([]byte, MAX_DATAGRAM_SIZE)
 
 	//client needs to send WRQ first
 	if !serverMode {
 		err := s.sendWriteRequest(dataGram)
 		if err != nil {
-			s.Log.Printf("Error starting transmission: %v", err)
+			s.logf("Error starting transmission: %v", err)
+			s.Reader.CloseWithError(err)
+			return err
+		}
+	} else if len(s.Options) > 0 {
+		//server confirms the negotiated options and waits for ACK 0 before sending data
+		oackPacket := OACK{s.Options}
+		err := s.sendAndWait(oackPacket.Pack(), 0, dataGram)
+		if err != nil {
+			s.logf("Error acknowledging options: %v", err)
 			s.Reader.CloseWithError(err)
-			return
+			return err
 		}
 	}
 	//received ACK to proceed with write
-	
-	var blockNum = uint16(1)
-	//keep sending packets until reach end of file
+	//size buffers for the block size and window that were agreed on
+	size := blockSize(s.Options)
+	dataGram = make([]byte, size+4)
+	window := make([][]byte, windowSize(s.Options))
+	var source io.Reader = s.Reader
+	if isNetascii(s.Mode) {
+		source = newNetasciiReader(s.Reader)
+	}
+	err = s.sendBlocks(source, window, size, dataGram)
+	if err != nil {
+		s.logf("Error sending %s: %v", s.FileName, err)
+		s.Reader.CloseWithError(err)
+		return err
+	}
+	s.Reader.Close()
+	return nil
+}
+
+//sends the file in windows of blocks (RFC 7440) until the last block is acknowledged.
+//without a negotiated window size every window holds a single block
+func (s *sender) sendBlocks(source io.Reader, window [][]byte, size int, dataGram []byte) error {
+	var acked, read int64//last block acknowledged by the receiver and last block read from the handler
+	var sent int64//last block sent at least once
+	final := int64(-1)//block that ends the file, once it has been read
+	slots := int64(len(window))
 	for {
-		dataLength, readErr := io.ReadFull(s.Reader, buffer)
-		if readErr != nil && readErr != io.ErrUnexpectedEOF {
-			//Error in case of EOF is actually not an error.
-			//file block size was 0, send 0-sized block to signal terminate
-			if readErr == io.EOF {
-				sendErr := s.sendPackets(buffer, 0, blockNum, dataGram)
-				if sendErr != nil && s.Log != nil {
-					s.Log.Printf("Error sending last zero-sized block: %v", sendErr)
-				}
-			} else {//unexpected EOF
-				if s.Log != nil {
-					s.Log.Printf("Handler error: %v", readErr)
-				}
-				errPacket := ERROR{1, readErr.Error()}
-				s.UDPConn.WriteToUDP(errPacket.Pack(), s.RemoteAddr)
-				s.Log.Printf("sent ERROR %d: %s", 1, readErr.Error())
+		//read ahead until the window is full
+		for final < 0 && read < acked+slots {
+			read++
+			slot := read % slots
+			if window[slot] == nil {
+				window[slot] = make([]byte, size)
+			}
+			dataLength, readErr := io.ReadFull(source, window[slot][:size])
+			if readErr != nil && s.ctx.Err() != nil {
+				return s.ctx.Err()
+			} else if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+				//handler failed. Let the other side know instead of leaving it waiting
+				errPacket := errorPacket(readErr, ERROR_UNDEFINED)
+				s.Conn.WriteTo(errPacket.Pack(), s.RemoteAddr)
+				s.logf("sent ERROR %d: %s", errPacket.ErrCode, errPacket.ErrMsg)
+				return fmt.Errorf("Handler error: %w", readErr)
+			}
+			window[slot] = window[slot][:dataLength]
+			if dataLength < size {
+				//block was not full, so that means EOF
+				final = read
 			}
-			s.Reader.Close()
-			return 
 		}
-		sendErr := s.sendPackets(buffer, dataLength, blockNum, dataGram)
-		if sendErr != nil {
-			if s.Log != nil {
-				s.Log.Printf("Error sending block %d: %v", blockNum, sendErr)
+
+		//(re)send every block that has not been acknowledged yet. Only a timeout or an ACK that
+		//moved forward gets here, never a duplicate ACK
+		for block := acked+1; block <= read; block++ {
+			dataPack := DATA{blockNumber(block, s.Rollover), window[block%slots]}
+			s.Conn.WriteTo(dataPack.Pack(), s.RemoteAddr)
+			s.logf("Sent data packet #%d", dataPack.BlockNum)
+		}
+		//only time windows of blocks that were never sent before
+		s.timer.sent(acked >= sent)
+		sent = read
+
+		setDeadlineErr := s.setTimeout()
+		if setDeadlineErr != nil {
+			return setDeadlineErr
+		}
+		ack, err := s.waitForAck(acked, read, dataGram)
+		if err == errTimedOut {
+			if s.timer.expired() {
+				return ERR_SEND_TIMEOUT
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		//receiver acknowledged part or all of the window. A partial ACK means the blocks
+		//after it were lost, so the next window starts right after it
+		acked = ack
+		s.timer.answered()
+		if acked == final {
+			return nil
+		}
+	}
+}
+
+//waits for an ACK of a block after acked and no later than sent
+//ACKs of earlier blocks are duplicates and are ignored rather than answered: resending on them would
+//send every later block twice (Sorcerer's Apprentice syndrome). They do not extend the wait either,
+//so blocks are only resent once the timeout expires
+func (s *sender) waitForAck(acked int64, sent int64, dataGram []byte) (int64, error) {
+	for {
+		dataLength, from, readErr := s.Conn.ReadFrom(dataGram)
+		if netErr, clear := readErr.(net.Error); clear && netErr.Timeout() {//timeout. Resend
+			if s.ctx.Err() != nil {//cancelled, nothing is resent
+				return acked, s.ctx.Err()
 			}
-			s.Reader.CloseWithError(sendErr)
-			return
+			return acked, errTimedOut
+		} else if readErr != nil {
+			return acked, fmt.Errorf("Error reading UDP packet: %v", readErr)
+		} else if !sameAddr(from, s.RemoteAddr) {
+			rejectUnknownTID(s.Conn, from)
+			continue
 		}
-		blockNum++
-		if dataLength < len(buffer) {
-			//last packet was not full, so that means EOF
-			defer s.Reader.Close()
-			return
+		packet, err := UnPack(dataGram[:dataLength])
+		if err != nil { //bad packet, wait for another one
+			continue
+		}
+		switch p := packet.(type) {
+			case *ACK:
+				s.logf("Sender received ACK %d", p.BlockNum)
+				distance := blockDistance(acked, p.BlockNum, s.Rollover)
+				if distance > 0 && distance <= sent-acked {
+					return acked+distance, nil
+				}
+			case *ERROR:
+				return acked, &TFTPError{p.ErrCode, p.ErrMsg}
 		}
 	}
 }
 
 //send write request to server from client
 func (s *sender) sendWriteRequest(dataGram []byte) error {
-	//allow for three attempts at sending request
-	for i:=0; i < 3; i++ {
-		writePacket := WRQ{s.FileName, s.Mode}
-		s.UDPConn.WriteToUDP(writePacket.Pack(), s.RemoteAddr)
-		s.Log.Printf("Write Request Sent (%s, %s)", s.FileName, s.Mode)
-		setDeadlineErr := s.UDPConn.SetReadDeadline(time.Now().Add(3*time.Second))
+	//allow for several attempts at sending request
+	for attempt := 0; ; attempt++ {
+		writePacket := WRQ{s.FileName, s.Mode, s.Options}
+		s.Conn.WriteTo(writePacket.Pack(), s.RemoteAddr)
+		s.logf("Write Request Sent (%s, %s)", s.FileName, s.Mode)
+		s.timer.sent(attempt == 0)
+		setDeadlineErr := s.setTimeout()
 		if setDeadlineErr != nil {
-			return fmt.Errorf("Failed to set up packet timeout: %v", setDeadlineErr)
+			return setDeadlineErr
 		}
 
 		for {
-			dataLength, remoteAddress, readErr := s.UDPConn.ReadFromUDP(dataGram)
+			dataLength, remoteAddress, readErr := s.Conn.ReadFrom(dataGram)
 			if netErr, clear := readErr.(net.Error); clear && netErr.Timeout() {//timeout. Resend
+				if s.ctx.Err() != nil {//cancelled, nothing is resent
+					return s.ctx.Err()
+				}
 				break
 			} else if readErr != nil {
 				return fmt.Errorf("Error reading UDP packet: %v", readErr)
@@ -111,39 +226,62 @@ func (s *sender) sendWriteRequest(dataGram []byte) error {
 			switch p := packet.(type) {
 				case *ACK:
 					if p.BlockNum == 0 {
-						s.Log.Printf("Sender received ACK 0")
+						s.logf("Sender received ACK 0")
+						s.timer.answered()
 						s.RemoteAddr = remoteAddress
+						//server ignored any options that were requested
+						s.Options = nil
 						return nil
 					}
+				case *OACK:
+					s.logf("Sender received OACK %v", p.Options)
+					s.timer.answered()
+					s.RemoteAddr = remoteAddress
+					err := checkOptionAck(s.Options, p.Options)
+					if err != nil {
+						errPacket := ERROR{ERROR_OPTION_REFUSED, err.Error()}
+						s.Conn.WriteTo(errPacket.Pack(), s.RemoteAddr)
+						return err
+					}
+					s.Options = p.Options
+					return nil
 				case *ERROR:
-					return fmt.Errorf("Transmission Error %d: %s", p.ErrCode, p.ErrMsg)
+					return &TFTPError{p.ErrCode, p.ErrMsg}
 			}
 		}
+		if s.timer.expired() {
+			return ERR_SEND_TIMEOUT
+		}
 	}
-	return ERR_SEND_TIMEOUT
 }
 
-//send block to server. 
-//Return error if send fails or if received error message instead of ack from server
-func (s *sender) sendPackets(b []byte, dataLength int, blockNum uint16, dataGram []byte) error {
-	//allow for three attempts at sending packet
-	for i := 0; i < 3; i++ {
-		setDeadlineErr := s.UDPConn.SetReadDeadline(time.Now().Add(3*time.Second))
+//send packet to the other side and wait for it to be acknowledged with blockNum
+//packet is resent on timeout
+func (s *sender) sendAndWait(packet []byte, blockNum uint16, dataGram []byte) error {
+	//allow for several attempts at sending packet
+	for attempt := 0; ; attempt++ {
+		setDeadlineErr := s.setTimeout()
 		if setDeadlineErr != nil {
-			return fmt.Errorf("Failed to set up packet timeout: %v", setDeadlineErr)
+			return setDeadlineErr
 		}
 
-		dataPack := DATA{blockNum, b[:dataLength]}
-		s.UDPConn.WriteToUDP(dataPack.Pack(), s.RemoteAddr)
-		s.Log.Printf("Sent data packet #%d", blockNum)
+		s.Conn.WriteTo(packet, s.RemoteAddr)
+		s.logf("Sent packet for block #%d", blockNum)
+		s.timer.sent(attempt == 0)
 
 		//wait for response from client
 		for {
-			dataLength, _, readErr := s.UDPConn.ReadFromUDP(dataGram)
+			dataLength, from, readErr := s.Conn.ReadFrom(dataGram)
 			if netErr, clear := readErr.(net.Error); clear && netErr.Timeout() {//timeout. Resend
+				if s.ctx.Err() != nil {//cancelled, nothing is resent
+					return s.ctx.Err()
+				}
 				break 
 			} else if readErr != nil {
 				return fmt.Errorf("Error reading UDP packet: %v", readErr)
+			} else if !sameAddr(from, s.RemoteAddr) {
+				rejectUnknownTID(s.Conn, from)
+				continue
 			}
 			packet, err := UnPack(dataGram[:dataLength])
 			if err != nil { //bad packet, wait for another one
@@ -151,14 +289,61 @@ func (s *sender) sendPackets(b []byte, dataLength int, blockNum uint16, dataGram
 			}
 			switch p := packet.(type) {
 				case *ACK:
-					s.Log.Printf("Sender received ACK %d", p.BlockNum)
+					s.logf("Sender received ACK %d", p.BlockNum)
 					if blockNum == p.BlockNum { //successful
+						s.timer.answered()
 						return nil
 					}
 				case *ERROR:
-					return fmt.Errorf("Transmit Error %d: %s", p.ErrCode, p.ErrMsg)
+					return &TFTPError{p.ErrCode, p.ErrMsg}
 			}
 		}
+		if s.timer.expired() {
+			return ERR_SEND_TIMEOUT
+		}
+	}
+}
+
+//tells the other side the transfer was cancelled
+func (s *sender) cancel() error {
+	errPacket := ERROR{ERROR_UNDEFINED, "Transfer cancelled"}
+	s.Conn.WriteTo(errPacket.Pack(), s.RemoteAddr)
+	return s.ctx.Err()
+}
+
+//prints to Log unless there is none
+func (s *sender) logf(format string, v ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, v...)
+	}
+}
+
+//starts waiting for an acknowledgement
+//fails once the transfer is cancelled so that no wait outlives ctx
+func (s *sender) setTimeout() error {
+	err := s.Conn.SetReadDeadline(time.Now().Add(s.timer.timeout()))
+	if err != nil {
+		return fmt.Errorf("Failed to set up packet timeout: %v", err)
+	}
+	return s.ctx.Err()
+}
+
+//time to wait for an acknowledgement, or the first guess at it if it adapts
+func (s *sender) timeout() time.Duration {
+	//the other side only resends after the timeout option, which holds whole seconds
+	if negotiated := timeoutOption(s.Options); negotiated > s.Timeout {
+		return negotiated
+	}
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DEFAULT_SEND_TIMEOUT
+}
+
+//number of times each packet is sent before giving up
+func (s *sender) retries() int {
+	if s.Retries > 0 {
+		return s.Retries
 	}
-	return ERR_SEND_TIMEOUT	
-}
\ No newline at end of file
+	return DEFAULT_RETRIES
+}
@@ -1,63 +1,288 @@
 package tftpOctet
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_WORKERS = 4 //goroutines reading from the listening socket unless configured
+)
+
+var (
+	ERR_SERVER_CLOSED = errors.New("Server closed")
+	ERR_SERVER_BUSY = errors.New("Server busy")//sent to clients while MaxTransfers transfers are running
+	errDuplicateRequest = errors.New("Transfer with client is already running")
 )
 
 //-------------------------------------------------------------------------------------------------------
 //Server Type provides TFTP functionality in Octet mode. Functions tied to this type 
-//are meant to be used by the server side to infinitely receive requests by clients and 
-//process them appropriately
+//are meant to be used by the server side to receive requests by clients until it is
+//shut down and process them appropriately
 //-------------------------------------------------------------------------------------------------------
 
 
 type Server struct {
 	BindAddr 		*net.UDPAddr//UDP address to listen for requests form clients
-	ReadHandler  	func(filename string, r *io.PipeWriter)//function provided by client that allows client to handle the file received
-	WriteHandler 	func(filename string, w *io.PipeReader)//function provided by client that dicates how client is going to load file to the Pipe
-	Log 			*log.Logger//Log that prints out important events of the server
+	ReadHandler  	ReadHandler//serves files clients read. nil refuses all reads
+	WriteHandler 	WriteHandler//serves files clients write. nil refuses all writes
+	Log 			*log.Logger//Log that prints out important events of the server. nil logs nothing
+	BlockSize 		int//largest block size the server agrees to (8-65464). 0 allows any size a client asks for
+	WindowSize 		int//largest window size the server agrees to (1-65535). 0 allows up to DEFAULT_MAX_WINDOW_SIZE
+	Timeout 		time.Duration//time to wait before resending a packet unless the client negotiates one. 0 uses the defaults
+	Retries 		int//attempts at sending each packet before a transfer fails. 0 uses DEFAULT_RETRIES
+	AdaptiveTimeout bool//resend after about the measured round trip time unless the client negotiates a timeout. Timeout is only the first guess and transfers still give up no sooner than with it
+	MinTimeout 		time.Duration//shortest adaptive timeout. 0 uses DEFAULT_MIN_ADAPTIVE_TIMEOUT
+	MaxTimeout 		time.Duration//longest adaptive timeout. 0 uses DEFAULT_MAX_ADAPTIVE_TIMEOUT
+	Rollover 		uint16//block number that follows 65535 in large transfers: 0 (default) or 1. Has to match the clients
+	Locks 			FileLocker//optional. Serializes reads and writes of the same file name, otherwise that is left to the handlers. Under WRITE_CREATE and WRITE_REPLACE a write is refused anyway while the same file is being written
+	WritePolicy 	WritePolicy//whether writes may create and replace files. WRITE_ANY leaves it to the WriteHandler
+	TransferIP 		net.IP//address transfer sockets are bound to. nil binds all addresses
+	TransferPorts 	PortRange//ports transfer sockets are bound to. The zero value uses any free port
+	SinglePort 		bool//run every transfer on the listening socket instead of a socket of its own. TransferIP and TransferPorts are not used
+	Workers 		int//goroutines reading packets from the listening socket. 0 uses DEFAULT_WORKERS
+	MaxTransfers 	int//transfers that may run at once, further requests are refused with ERR_SERVER_BUSY. 0 means no limit
+	Transport 		Transport//opens the server's sockets. nil uses UDP
+
+	mutex 			sync.Mutex//guards the fields below
+	conn 			net.PacketConn//socket listening for requests while the server runs
+	closed 			bool//set by Shutdown and Close. No new transfers start afterwards
+	ctx 			context.Context//cancelled to abort all transfers
+	cancel 			context.CancelFunc
+	transfers 		sync.WaitGroup//running transfers and their handlers
+	active 			int//transfers counted against MaxTransfers
+	clients 		map[string]bool//addresses of clients with a running transfer
+	routes 			map[string]*demuxConn//transfers on the listening socket by client address in single port mode
+	dallying 		map[*dallyingWrite]bool//finished writes waiting for repeats of their last block
+	writing 		map[string]bool//files being written under WRITE_CREATE and WRITE_REPLACE
 }
 
-//Only function that is can be called externally
-//runs infinitely, listening for requests through the port dictated by BindAddr
-func (s Server) Startup() error {
-	conn, err := net.ListenUDP(UDP_NET, s.BindAddr)
+//runs until Shutdown or Close is called, listening for requests through the port dictated by BindAddr.
+//Returns ERR_SERVER_CLOSED once the server has been shut down
+func (s *Server) Startup() error {
+	if s.Rollover > 1 {
+		return fmt.Errorf("Block number rollover must be 0 or 1: %d", s.Rollover)
+	}
+	err := s.checkWritePolicy()
+	if err != nil {
+		return err
+	}
+	err = s.TransferPorts.check()
+	if err != nil {
+		return err
+	}
+	err = checkAdaptiveTimeouts(s.MinTimeout, s.MaxTimeout)
+	if err != nil {
+		return err
+	}
+	conn, err := defaultTransport(s.Transport).ListenPacket(s.BindAddr)
 	if err != nil {
 		return err
 	}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		conn.Close()
+		return ERR_SERVER_CLOSED
+	}
+	s.conn = conn
+	s.mutex.Unlock()
+	//read packets with several workers so that a burst of requests does not queue up behind one
+	workers := s.Workers
+	if workers < 1 {
+		workers = DEFAULT_WORKERS
+	}
+	var wait sync.WaitGroup
+	wait.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wait.Done()
+			s.listen(conn)
+		}()
+	}
+	wait.Wait()
+	return ERR_SERVER_CLOSED
+}
+
+//worker handling packets from the listening socket until the server is shut down
+//every worker reuses a buffer of its own
+func (s *Server) listen(conn net.PacketConn) {
+	//in single port mode data for transfers arrives here too, in blocks of any size
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	if s.SinglePort {
+		buffer = make([]byte, MAX_BLOCK_SIZE+4)
+	}
 	for {
-		err = s.handleRequest(conn)
+		err := s.handleRequest(conn, buffer)
 		if err != nil {
-			if s.Log != nil {
-				s.Log.Printf("%v\n", err)
+			if s.isClosed() && errors.Is(err, net.ErrClosed) {
+				return
 			}
+			s.logf("%v\n", err)
 		}
 	}
 }
 
-//establish the UDP "connection" 
-func (s Server) transmissionConn() (*net.UDPConn, error) {
-	addr, err := net.ResolveUDPAddr(UDP_NET, ":0")
-	if err != nil {
-		return nil, err
+//address the server is listening on. nil until Startup is running
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return nil
 	}
-	conn, err := net.ListenUDP(UDP_NET, addr)
-	if err != nil {
-		return nil, err
+	return s.conn.LocalAddr()
+}
+
+//stops accepting requests and waits for running transfers to finish.
+//If ctx is done first the remaining transfers are aborted with an ERROR packet to
+//their clients and ctx.Err() is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopListening()
+	done := make(chan struct{})
+	go func() {
+		s.transfers.Wait()
+		close(done)
+	}()
+	defer s.closeConn()
+	//finished writes only wait for repeats of their last block, which are not worth waiting for
+	defer s.stopDallying()
+	select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			s.transferContext()
+			s.cancel()
+			<-done
+			return ctx.Err()
 	}
-	return conn, nil
 }
 
-//helper function that is called to handle potential requests by client 
-func (s Server) handleRequest(conn *net.UDPConn) error {
-	var buffer []byte
-	buffer = make([]byte, MAX_DATAGRAM_SIZE)
-	num, returnAddr, err := conn.ReadFromUDP(buffer)
+//stops accepting requests and aborts all running transfers right away
+func (s *Server) Close() error {
+	s.stopListening()
+	s.transferContext()
+	s.cancel()
+	s.transfers.Wait()
+	s.stopDallying()
+	s.closeConn()
+	return nil
+}
+
+//closes the listening socket and keeps any more transfers from starting
+//in single port mode the socket stays open for the running transfers
+func (s *Server) stopListening() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if s.conn != nil && !s.SinglePort {
+		s.conn.Close()
+	}
+}
+
+//closes the listening socket once no transfer uses it any more
+func (s *Server) closeConn() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+//prints to Log unless there is none
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, v...)
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+//context shared by all transfers so they can be aborted together
+func (s *Server) transferContext() context.Context {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+//serves a request in its own goroutine
+//Nothing is started once the server is shut down or while MaxTransfers transfers are running
+//A client that repeats its request while its transfer is running gets no second one
+func (s *Server) startTransfer(addr *net.UDPAddr, serve func(ctx context.Context) error) error {
+	ctx := s.transferContext()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ERR_SERVER_CLOSED
+	}
+	if s.clients[addr.String()] {
+		return errDuplicateRequest
+	}
+	if s.MaxTransfers > 0 && s.active >= s.MaxTransfers {
+		return ERR_SERVER_BUSY
+	}
+	if s.clients == nil {
+		s.clients = map[string]bool{}
+	}
+	s.clients[addr.String()] = true
+	s.active++
+	s.transfers.Add(1)
+	go func() {
+		defer s.transfers.Done()
+		defer s.endTransfer(addr)
+		err := serve(ctx)
+		if err != nil {
+			s.logf("%v\n", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) endTransfer(addr *net.UDPAddr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active--
+	delete(s.clients, addr.String())
+}
+
+//establish the UDP "connection"
+//in single port mode the transfer shares the listening socket conn
+func (s *Server) transmissionConn(conn net.PacketConn, addr *net.UDPAddr) (net.PacketConn, error) {
+	if s.SinglePort {
+		return s.demuxConn(conn, addr)
+	}
+	transConn, err := s.TransferPorts.listen(defaultTransport(s.Transport), s.TransferIP)
+	if errors.Is(err, ERR_NO_FREE_PORT) && s.stopDallying() {
+		//finished writes gave up their ports
+		return s.TransferPorts.listen(defaultTransport(s.Transport), s.TransferIP)
+	}
+	return transConn, err
+}
+
+//helper function that is called to handle potential requests by client
+func (s *Server) handleRequest(conn net.PacketConn, buffer []byte) error {
+	num, from, err := conn.ReadFrom(buffer)
 	if err != nil {
-		return fmt.Errorf("Attempt to read data from client failed: %v", err)
+		return fmt.Errorf("Attempt to read data from client failed: %w", err)
+	}
+	returnAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("Packet from unsupported address %v", from)
+	}
+	if s.SinglePort && s.demux(returnAddr, buffer[:num]) {
+		return nil
 	}
 	//create packet from data received in buffer
 	packet, err := UnPack(buffer[:num])
@@ -66,27 +291,191 @@ func (s Server) handleRequest(conn *net.UDPConn) error {
 	}
 	switch p := packet.(type) {
 		case *RRQ://Read Request
-			s.Log.Printf("Server received read request (%s, %s)", p.FileName, p.Mode)
-			transConn, err := s.transmissionConn()
-			if err != nil {
-				return fmt.Errorf("Attempt at transmission setup failed: %v", err)
-			}
-			read, write := io.Pipe()
-			//set up sender type to handle sending of file to client
-			send := &sender{returnAddr, transConn, read, p.FileName, p.Mode, s.Log}
-			go s.ReadHandler(p.FileName, write)
-			go send.run(true)
+			s.logf("Server received read request (%s, %s)", p.FileName, p.Mode)
+			err = s.startTransfer(returnAddr, func(ctx context.Context) error {
+				return s.serveRead(ctx, conn, returnAddr, p)
+			})
 		case *WRQ://Write Request
-			s.Log.Printf("Server received write request (%s, %s)", p.FileName, p.Mode)
-			transConn, err := s.transmissionConn()
-			if err != nil {
-				return fmt.Errorf("Attempt at transmission setup failed: %v", err)
+			s.logf("Server received write request (%s, %s)", p.FileName, p.Mode)
+			err = s.startTransfer(returnAddr, func(ctx context.Context) error {
+				return s.serveWrite(ctx, conn, returnAddr, p)
+			})
+		case *DATA, *ACK:
+			//in single port mode these belong to a transfer, but not to any that is running
+			if s.SinglePort {
+				rejectUnknownTID(conn, returnAddr)
 			}
-			read, write := io.Pipe()
-			//set up receiver type to handle receiving of file from client
-			receive := &receiver{returnAddr, transConn, write, p.FileName, p.Mode, s.Log}
-			go s.WriteHandler(p.FileName, read)
-			go receive.run(true)
 	}
-	return nil
-}
\ No newline at end of file
+	if err == ERR_SERVER_BUSY {
+		return s.refuse(conn, returnAddr, ERROR_UNDEFINED, err)
+	} else if err == errDuplicateRequest {
+		//the client's first request was answered already, the running transfer resends its reply if that got lost
+		s.logf("Ignored repeated request from %v", returnAddr)
+		return nil
+	}
+	return err
+}
+
+//asks the ReadHandler for the file and sends it to the client
+//a refused request is answered from the server's port, the transfer runs on a port of its own
+func (s *Server) serveRead(ctx context.Context, conn net.PacketConn, addr *net.UDPAddr, p *RRQ) error {
+	err := checkMode(p.Mode)
+	if err != nil {
+		return s.refuse(conn, addr, ERROR_ILLEGAL_OPERATION, err)
+	}
+	if s.ReadHandler == nil {
+		return s.refuse(conn, addr, ERROR_ACCESS_VIOLATION, fmt.Errorf("Reads are not allowed: %s", p.FileName))
+	}
+	//hold the file until the transfer is done with it
+	if s.Locks != nil {
+		s.Locks.RLock(p.FileName)
+		defer s.Locks.RUnlock(p.FileName)
+	}
+	request := &Request{FileName: p.FileName, Mode: p.Mode, Options: p.Options, RemoteAddr: addr, TransferSize: -1}
+	stream, err := s.ReadHandler.ServeRead(request)
+	if err != nil {
+		return s.refuse(conn, addr, ERROR_UNDEFINED, err)
+	}
+	defer closeStream(stream)
+	size := streamSize(stream)
+	if isNetascii(p.Mode) {
+		//the file grows when its line endings are translated, so its size is not what the client receives
+		size = -1
+	}
+	options := s.negotiate(p.Options, size, false)
+	transConn, err := s.transmissionConn(conn, addr)
+	if err != nil {
+		return s.refuse(conn, addr, ERROR_UNDEFINED, fmt.Errorf("Attempt at transmission setup failed: %w", err))
+	}
+	defer transConn.Close()
+	read, write := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := stream.WriteTo(write)
+		write.CloseWithError(err)
+	}()
+	//set up sender type to handle sending of file to client
+	send := &sender{RemoteAddr: addr, Conn: transConn, Reader: read, FileName: p.FileName, Mode: p.Mode, Options: options, Timeout: s.transferTimeout(options), Retries: s.Retries, Adaptive: s.adaptiveTimeout(options), MinTimeout: s.MinTimeout, MaxTimeout: s.MaxTimeout, Rollover: s.Rollover, Log: s.Log}
+	err = send.run(ctx, true)
+	<-done
+	return err
+}
+
+//asks the WriteHandler where to store the file and receives it from the client
+//a refused request is answered from the server's port, the transfer runs on a port of its own
+func (s *Server) serveWrite(ctx context.Context, conn net.PacketConn, addr *net.UDPAddr, p *WRQ) error {
+	err := checkMode(p.Mode)
+	if err != nil {
+		return s.refuse(conn, addr, ERROR_ILLEGAL_OPERATION, err)
+	}
+	if s.WriteHandler == nil {
+		return s.refuse(conn, addr, ERROR_ACCESS_VIOLATION, fmt.Errorf("Writes are not allowed: %s", p.FileName))
+	}
+	release, err := s.allowWrite(p.FileName)
+	if err != nil {
+		return s.refuse(conn, addr, ERROR_ACCESS_VIOLATION, err)
+	}
+	defer release()
+	//hold the file until the transfer is done with it
+	if s.Locks != nil {
+		s.Locks.Lock(p.FileName)
+		defer s.Locks.Unlock(p.FileName)
+	}
+	request := &Request{FileName: p.FileName, Mode: p.Mode, Options: p.Options, RemoteAddr: addr, TransferSize: transferSize(p.Options)}
+	stream, err := s.WriteHandler.ServeWrite(request)
+	if err != nil {
+		return s.refuse(conn, addr, ERROR_UNDEFINED, err)
+	}
+	defer closeStream(stream)
+	options := s.negotiate(p.Options, request.TransferSize, true)
+	transConn, err := s.transmissionConn(conn, addr)
+	if err != nil {
+		return s.refuse(conn, addr, ERROR_UNDEFINED, fmt.Errorf("Attempt at transmission setup failed: %w", err))
+	}
+	dallying := false
+	defer func() {
+		if !dallying {
+			transConn.Close()
+		}
+	}()
+	read, write := io.Pipe()
+	done := make(chan struct{})
+	var storeErr error
+	go func() {
+		defer close(done)
+		_, storeErr = stream.ReadFrom(read)
+		read.CloseWithError(storeErr)
+	}()
+	//set up receiver type to handle receiving of file from client
+	receive := &receiver{RemoteAddr: addr, Conn: transConn, Writer: write, FileName: p.FileName, Mode: p.Mode, Options: options, Timeout: s.transferTimeout(options), Retries: s.Retries, Adaptive: s.adaptiveTimeout(options), MinTimeout: s.MinTimeout, MaxTimeout: s.MaxTimeout, Rollover: s.Rollover, Log: s.Log}
+	//the client is told the write succeeded only once the handler has stored all of the file
+	receive.Finish = func() error {
+		write.Close()
+		<-done
+		return storeErr
+	}
+	err = receive.run(ctx, true)
+	<-done
+	if err == nil {
+		dallying = true
+		s.dally(ctx, receive, transConn)
+	}
+	return err
+}
+
+//finished write that still acknowledges repeats of its last block
+type dallyingWrite struct {
+	stop 	context.CancelFunc
+	done 	chan struct{}//closed once its socket is closed
+}
+
+//keeps acknowledging a write whose last ACK may have been lost in the background
+//the client's place is given up already, so a new request from it starts a new transfer.
+//Shutdown does not wait for it, and it gives up its port if the server runs out of them
+func (s *Server) dally(ctx context.Context, receive *receiver, transConn net.PacketConn) {
+	if d, ok := transConn.(*demuxConn); ok {
+		d.finished.Store(true)
+	}
+	ctx, stop := context.WithCancel(ctx)
+	write := &dallyingWrite{stop: stop, done: make(chan struct{})}
+	s.mutex.Lock()
+	if s.dallying == nil {
+		s.dallying = map[*dallyingWrite]bool{}
+	}
+	s.dallying[write] = true
+	s.mutex.Unlock()
+	go func() {
+		defer close(write.done)
+		defer stop()
+		receive.dally(ctx)
+		transConn.Close()
+		s.mutex.Lock()
+		delete(s.dallying, write)
+		s.mutex.Unlock()
+	}()
+}
+
+//ends all finished writes that are still acknowledging their last block and waits until their sockets are closed
+//returns false if there were none
+func (s *Server) stopDallying() bool {
+	s.mutex.Lock()
+	writes := make([]*dallyingWrite, 0, len(s.dallying))
+	for write := range s.dallying {
+		write.stop()
+		writes = append(writes, write)
+	}
+	s.mutex.Unlock()
+	for _, write := range writes {
+		<-write.done
+	}
+	return len(writes) > 0
+}
+
+//answers a request the server will not serve with an ERROR packet
+//errCode is used unless err is a TFTPError
+func (s *Server) refuse(conn net.PacketConn, addr *net.UDPAddr, errCode uint16, err error) error {
+	errPacket := errorPacket(err, errCode)
+	conn.WriteTo(errPacket.Pack(), addr)
+	return fmt.Errorf("Refused request from %v: %v", addr, err)
+}
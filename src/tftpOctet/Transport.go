@@ -0,0 +1,132 @@
+package tftpOctet
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//-------------------------------------------------------------------------------------------------------
+//Servers and clients open their sockets through a Transport. UDPTransport, the default, opens
+//real UDP sockets. MemoryNetwork connects servers and clients of the same process without any,
+//so tests and simulations can run many transfers without depending on free ports
+//-------------------------------------------------------------------------------------------------------
+
+//opens sockets for servers and clients
+//the sockets have to report addresses as *net.UDPAddr
+type Transport interface {
+	ListenPacket(addr *net.UDPAddr) (net.PacketConn, error)
+}
+
+//Transport of UDP sockets
+type UDPTransport struct{}
+
+func (UDPTransport) ListenPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	conn, err := net.ListenUDP(UDP_NET, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+//transport to use when none was configured
+func defaultTransport(transport Transport) Transport {
+	if transport == nil {
+		return UDPTransport{}
+	}
+	return transport
+}
+
+//buffers holding packets until they are read from a socket that is not a UDP socket
+//reused so that sockets keep up without allocating for every packet
+var packetPool = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, 0, MAX_BLOCK_SIZE+4)
+	return &buffer
+}}
+
+//packets waiting to be read from a socket that is not a UDP socket
+//reads honour the read deadline the way they do on a UDP socket
+type packetQueue struct {
+	packets 	chan queuedPacket
+	closed 		chan struct{}//closed by close
+	closeOnce 	sync.Once
+
+	mutex 		sync.Mutex//guards the fields below
+	deadline 	time.Time
+	changed 	chan struct{}//closed whenever the deadline changes
+}
+
+type queuedPacket struct {
+	data 	*[]byte//from packetPool
+	from 	net.Addr
+}
+
+func newPacketQueue(size int) *packetQueue {
+	return &packetQueue{packets: make(chan queuedPacket, size), closed: make(chan struct{}), changed: make(chan struct{})}
+}
+
+//queues a copy of packet
+//the packet is dropped if the queue is full, like a full socket buffer would
+func (q *packetQueue) push(from net.Addr, packet []byte) {
+	buffer := packetPool.Get().(*[]byte)
+	*buffer = append((*buffer)[:0], packet...)
+	select {
+		case q.packets <- queuedPacket{buffer, from}:
+		default:
+			packetPool.Put(buffer)
+	}
+}
+
+func (q *packetQueue) read(b []byte) (int, net.Addr, error) {
+	for {
+		q.mutex.Lock()
+		deadline, changed := q.deadline, q.changed
+		q.mutex.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		var packet queuedPacket
+		var err error
+		select {
+			case packet = <-q.packets:
+			case <-expired:
+				err = os.ErrDeadlineExceeded
+			case <-changed://wait again with the new deadline
+			case <-q.closed:
+				err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, nil, err
+		} else if packet.data != nil {
+			n := copy(b, *packet.data)
+			packetPool.Put(packet.data)
+			return n, packet.from, nil
+		}
+	}
+}
+
+func (q *packetQueue) setReadDeadline(t time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.deadline = t
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+//ends all reads, now and later
+func (q *packetQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+}
@@ -2,23 +2,37 @@ package tftpOctet
 
 import (
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"log"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const(
 	TRANSFER_MODE = "octet"	
+	MAX_FILE_SIZE = 1 << 20//largest file the test server accepts when the size is announced
 )
 
 
 var (
 	c *Client
 	s *Server
+	network = &MemoryNetwork{}//network of s and c, and of proxies
+	nobody = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3011}//nothing listens here on network
 	m = map[string][]byte{}//our "Server Memory Location"
 	mutex sync.Mutex//Eliminates Race Condition and helps with Syncronization 
 )
@@ -26,13 +40,16 @@ var (
 //main test function
 //set up the server and client and start up server
 func TestMain(m *testing.M) {
-	addr, _ := net.ResolveUDPAddr(UDP_NET, "localhost:3009")
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 69}
 	log := log.New(os.Stderr, "", log.Ldate|log.Ltime)
 
-	s = &Server{addr, handleRead, handleWrite, log}
+	s = &Server{BindAddr: addr, ReadHandler: memory, WriteHandler: memory, Log: log, WritePolicy: WRITE_CREATE, Transport: network}
 	go s.Startup()
+	for s.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
 
-	c = &Client{addr, log}
+	c = &Client{RemoteAddr: addr, Log: log, Transport: network}
 
 	os.Exit(m.Run())
 }
@@ -40,6 +57,7 @@ func TestMain(m *testing.M) {
 //writes file to server and reads same file from server
 //checks that both files are the same
 func TestBasicWriteAndRead(t *testing.T) {
+	forgetFiles(t)
 	filename := "first-write"
 	mode := TRANSFER_MODE
 	buffer := []byte("I want to see that this message can be written to the server byte by byte")
@@ -56,63 +74,1923 @@ func TestBasicWriteAndRead(t *testing.T) {
 	if !bytes.Equal(buffer, returnBuffer.Bytes()) {
 		t.Fatalf("sent: %s, received: %s", string(buffer), returnBuffer.String())
 	} else {
-		t.Log("%s successfully sent to server", filename)
+		t.Logf("%s successfully sent to server", filename)
 	}
 }
 
 func TestCheckDoubleWrite(t *testing.T) {
+	forgetFiles(t)
 	filename := "DuplicateWrite"
 	mode := TRANSFER_MODE
 	bufferOne := []byte("This is a message that should not be written twice to memory")
-	c.WriteFile(filename, mode, func (w *io.PipeWriter) {
+	err := c.WriteFile(filename, mode, func (w *io.PipeWriter) {
 		for i := 0; i < len(bufferOne); i++ {
 			w.Write(bufferOne[i:i+1])
 		}
 		defer w.Close()
 	})
-	c.WriteFile(filename, mode, func (w *io.PipeWriter) {
+	if err != nil {
+		t.Fatalf("First write failed: %v", err)
+	}
+	err = c.WriteFile(filename, mode, func (w *io.PipeWriter) {
 		for i := 0; i < len(bufferOne); i++ {
 			w.Write(bufferOne[i:i+1])
 		}
 		defer w.Close()
 	})
+	var tftpErr *TFTPError
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_FILE_EXISTS {
+		t.Fatalf("Expected file already exists, got %v", err)
+	}
+	mutex.Lock()
+	stored := m[filename]
+	mutex.Unlock()
+	if !bytes.Equal(bufferOne, stored) {
+		t.Fatalf("File was changed by the second write: %s", stored)
+	}
 }
 
-//function receiver uses to handle writes to it
-func handleWrite(filename string, r *io.PipeReader) {
+//every way a transfer can fail is reported by WriteFile and ReadFile
+func TestTransferErrors(t *testing.T) {
+	forgetFiles(t)
+	//nobody answers
+	client := &Client{RemoteAddr: nobody, Transport: network, Log: c.Log, Timeout: 100*time.Millisecond, Retries: 2}
+	err := client.WriteFile("errors-timeout", TRANSFER_MODE, func(w *io.PipeWriter) {
+		w.Write([]byte("nobody listens"))
+		w.Close()
+	})
+	if err != ERR_SEND_TIMEOUT {
+		t.Fatalf("Expected send timeout, got %v", err)
+	}
+	err = client.ReadFile("errors-timeout", TRANSFER_MODE, func(r *io.PipeReader) {
+		io.Copy(io.Discard, r)
+	})
+	if err != ERR_RECEIVE_TIMEOUT {
+		t.Fatalf("Expected receive timeout, got %v", err)
+	}
+
+	//server fails partway through a write
+	server := &Server{WriteHandler: WriteHandlerFunc(func(r *Request) (io.ReaderFrom, error) {
+		return failingFile{}, nil
+	}), Log: s.Log}
+	client = &Client{RemoteAddr: startServer(t, server), Log: c.Log}
+	defer server.Close()
+	err = client.WriteFile("errors-remote", TRANSFER_MODE, func(w *io.PipeWriter) {
+		w.Write(bytes.Repeat([]byte("r"), BLOCK_SIZE*4))
+		w.Close()
+	})
+	var tftpErr *TFTPError
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_DISK_FULL {
+		t.Fatalf("Expected disk full, got %v", err)
+	}
+
+	//local handlers fail
+	handlerErr := errors.New("handler failed")
+	err = c.WriteFile("errors-local", TRANSFER_MODE, func(w *io.PipeWriter) {
+		w.Write(bytes.Repeat([]byte("l"), BLOCK_SIZE*2))
+		w.CloseWithError(handlerErr)
+	})
+	if !errors.Is(err, handlerErr) {
+		t.Fatalf("Expected handler error, got %v", err)
+	}
+	writeAndRead(t, c, "errors-local-read", bytes.Repeat([]byte("l"), BLOCK_SIZE*3))
+	err = c.ReadFile("errors-local-read", TRANSFER_MODE, func(r *io.PipeReader) {
+		r.Read(make([]byte, 10))
+		r.CloseWithError(handlerErr)
+	})
+	if !errors.Is(err, handlerErr) {
+		t.Fatalf("Expected handler error, got %v", err)
+	}
+	err = c.ReadFile("errors-local-read", TRANSFER_MODE, func(r *io.PipeReader) {
+		r.Read(make([]byte, 10))
+	})
+	if err == nil {
+		t.Fatalf("Handler that stopped reading early was not reported")
+	}
+}
+
+//file that runs out of space after the first block
+type failingFile struct{}
+
+func (failingFile) ReadFrom(r io.Reader) (int64, error) {
+	n, _ := r.Read(make([]byte, BLOCK_SIZE))
+	return int64(n), &TFTPError{ERROR_DISK_FULL, "Disk full"}
+}
+
+//writes data with the client's block size and checks it reads back the same
+func writeAndRead(t *testing.T, client *Client, filename string, data []byte) {
+	forgetFiles(t)
+	err := client.WriteFile(filename, TRANSFER_MODE, func(w *io.PipeWriter) {
+		w.Write(data)
+		w.Close()
+	})
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", filename, err)
+	}
+	returnBuffer := new(bytes.Buffer)
+	err = client.ReadFile(filename, TRANSFER_MODE, func(r *io.PipeReader) {
+		returnBuffer.ReadFrom(r)
+	})
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", filename, err)
+	}
+	if !bytes.Equal(data, returnBuffer.Bytes()) {
+		t.Fatalf("%s: sent %d bytes, received %d bytes", filename, len(data), returnBuffer.Len())
+	}
+}
+
+//empties the memory of the test servers once the test is over
+//so that the files it wrote can be created again when the tests are run repeatedly
+func forgetFiles(t *testing.T) {
+	t.Cleanup(func() {
+		mutex.Lock()
+		clear(m)
+		mutex.Unlock()
+	})
+}
+
+//read and write requests keep their options when packed and unpacked
+func TestRequestOptions(t *testing.T) {
+	request := &RRQ{"options-file", TRANSFER_MODE, map[string]string{"blksize": "1024", "tsize": "0"}}
+	packet, err := UnPack(request.Pack())
+	if err != nil {
+		t.Fatalf("Failed to unpack request: %v", err)
+	}
+	p, ok := packet.(*RRQ)
+	if !ok {
+		t.Fatalf("Expected RRQ, got %T", packet)
+	}
+	if p.FileName != request.FileName || p.Mode != request.Mode {
+		t.Fatalf("sent: (%s, %s), received: (%s, %s)", request.FileName, request.Mode, p.FileName, p.Mode)
+	}
+	if len(p.Options) != 2 || p.Options["blksize"] != "1024" || p.Options["tsize"] != "0" {
+		t.Fatalf("Options not preserved: %v", p.Options)
+	}
+	//option names are case insensitive
+	packet, err = UnPack(append((&WRQ{"f", TRANSFER_MODE, nil}).Pack(), "BlkSize\x00512\x00"...))
+	if err != nil {
+		t.Fatalf("Failed to unpack request: %v", err)
+	}
+	if value := packet.(*WRQ).Options["blksize"]; value != "512" {
+		t.Fatalf("Expected blksize 512, got %q", value)
+	}
+}
+
+//OACK packets round trip and may only hold options the client requested
+func TestOptionAck(t *testing.T) {
+	oack := &OACK{map[string]string{"blksize": "1428"}}
+	packet, err := UnPack(oack.Pack())
+	if err != nil {
+		t.Fatalf("Failed to unpack OACK: %v", err)
+	}
+	p, ok := packet.(*OACK)
+	if !ok || p.Options["blksize"] != "1428" {
+		t.Fatalf("OACK not preserved: %v", packet)
+	}
+	if err := checkOptionAck(map[string]string{"blksize": "1428"}, p.Options); err != nil {
+		t.Fatalf("Requested option rejected: %v", err)
+	}
+	if err := checkOptionAck(map[string]string{"tsize": "0"}, p.Options); err == nil {
+		t.Fatalf("Unrequested option accepted")
+	}
+}
+
+//transfers with a negotiated block size, including one that ends on a block boundary
+func TestBlockSize(t *testing.T) {
+	forgetFiles(t)
+	client := &Client{RemoteAddr: c.RemoteAddr, Transport: network, Log: c.Log, BlockSize: 1428}
+	writeAndRead(t, client, "blksize-1428", bytes.Repeat([]byte("0123456789"), 1000))
+	writeAndRead(t, client, "blksize-boundary", bytes.Repeat([]byte("x"), 1428*3))
+	client.BlockSize = MIN_BLOCK_SIZE
+	writeAndRead(t, client, "blksize-8", []byte("smallest block size there is"))
+	client.BlockSize = MAX_BLOCK_SIZE + 1
+	err := client.WriteFile("blksize-invalid", TRANSFER_MODE, func(w *io.PipeWriter) {
+		w.Close()
+	})
+	if err == nil {
+		t.Fatalf("Invalid block size accepted")
+	}
+}
+
+//server lowers the block size a client asks for to its own maximum
+func TestBlockSizeLimit(t *testing.T) {
+	limited := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, BlockSize: 600, Transport: network}
+	client := &Client{RemoteAddr: startServer(t, limited), Log: c.Log, BlockSize: 1400, Transport: network}
+	defer limited.Close()
+	writeAndRead(t, client, "blksize-limited", bytes.Repeat([]byte("abc"), 1000))
+	if accepted := limited.negotiate(map[string]string{OPTION_BLKSIZE: "1400"}, -1, false); accepted[OPTION_BLKSIZE] != "600" {
+		t.Fatalf("Expected block size 600, got %v", accepted)
+	}
+}
+
+//client learns the size of a file before reading it and announces the size of files it writes
+func TestTransferSize(t *testing.T) {
+	forgetFiles(t)
+	filename := "tsize-file"
+	data := bytes.Repeat([]byte("tsize"), 300)
+	err := c.WriteFileSize(filename, TRANSFER_MODE, int64(len(data)), func(w *io.PipeWriter) {
+		w.Write(data)
+		w.Close()
+	})
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", filename, err)
+	}
+	size, err := c.FileSize(filename, TRANSFER_MODE)
+	if err != nil {
+		t.Fatalf("Failed to get size of %s: %v", filename, err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Expected size %d, got %d", len(data), size)
+	}
+	if _, err = c.FileSize("tsize-missing", TRANSFER_MODE); err == nil {
+		t.Fatalf("Got size of file that does not exist")
+	}
+}
+
+//server refuses a write whose announced size is too large before any data is sent
+func TestTransferSizeTooLarge(t *testing.T) {
+	forgetFiles(t)
+	filename := "tsize-too-large"
+	var writeErr error
+	err := c.WriteFileSize(filename, TRANSFER_MODE, MAX_FILE_SIZE+1, func(w *io.PipeWriter) {
+		_, writeErr = w.Write([]byte("never sent"))
+		w.Close()
+	})
+	var tftpErr *TFTPError
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_DISK_FULL {
+		t.Fatalf("Expected disk full, got %v", err)
+	} else if writeErr == nil {
+		t.Fatalf("Oversize write was not refused")
+	}
 	mutex.Lock()
 	_, exists := m[filename]
+	mutex.Unlock()
 	if exists {
-		r.CloseWithError(fmt.Errorf("file already exists in memory: %s", filename))
-		return
+		t.Fatalf("Oversize file was stored")
 	}
-	buffer := new(bytes.Buffer)
-	datalength, err := buffer.ReadFrom(r)
+}
+
+//timeout option is echoed by the server and used by both sides
+func TestTimeout(t *testing.T) {
+	client := &Client{RemoteAddr: c.RemoteAddr, Transport: network, Log: c.Log, Timeout: 2*time.Second, Retries: 5}
+	writeAndRead(t, client, "timeout-2s", []byte("negotiated timeout"))
+	accepted := s.negotiate(map[string]string{OPTION_TIMEOUT: "2"}, -1, false)
+	if s.transferTimeout(accepted) != 2*time.Second {
+		t.Fatalf("Expected timeout of 2s, got %v", accepted)
+	}
+	for _, value := range []string{"0", "256", "soon"} {
+		accepted = s.negotiate(map[string]string{OPTION_TIMEOUT: value}, -1, false)
+		if _, ok := accepted[OPTION_TIMEOUT]; ok {
+			t.Fatalf("Invalid timeout %s accepted", value)
+		}
+	}
+}
+
+//client gives up after its configured number of retries
+func TestTimeoutRetries(t *testing.T) {
+	client := &Client{RemoteAddr: nobody, Transport: network, Log: c.Log, Timeout: time.Second, Retries: 2}
+	start := time.Now()
+	_, err := client.FileSize("no-server", TRANSFER_MODE)
+	if err != ERR_RECEIVE_TIMEOUT {
+		t.Fatalf("Expected receive timeout, got %v", err)
+	}
+	//the default of 3 retries would take 3s
+	if elapsed := time.Since(start); elapsed > 2500*time.Millisecond {
+		t.Fatalf("Took %v to give up", elapsed)
+	}
+}
+
+//a timeout shorter than a second is requested as one second, so the client waits that long too
+//and does not give up before the server resends a lost packet
+func TestSubSecondTimeout(t *testing.T) {
+	forgetFiles(t)
+	lossy := &MemoryNetwork{}
+	var drop int32//opcode of the next packet to lose. 0 loses none
+	lossy.Drop = func(packet []byte, from net.Addr, to net.Addr) bool {
+		opcode := int32(binary.BigEndian.Uint16(packet))
+		return opcode != 0 && atomic.CompareAndSwapInt32(&drop, opcode, 0)
+	}
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, Transport: lossy, WritePolicy: WRITE_CREATE}
+	addr := startServer(t, server)
+	defer server.Close()
+	client := &Client{RemoteAddr: addr, Log: c.Log, Transport: lossy, Timeout: 100*time.Millisecond}
+	data := bytes.Repeat([]byte("s"), 1000)
+	//repeated WRQs are ignored, only the server resends the OACK
+	atomic.StoreInt32(&drop, int32(OPCODE_OACK))
+	_, err := client.Put("sub-second-timeout", bytes.NewReader(data))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read %s: %v", filename, err)
-	} else {
-		fmt.Fprintf(os.Stderr, "Received %s (%d bytes)", filename, datalength)
-		m[filename] = append(m[filename], buffer.Bytes()...)
+		t.Fatalf("Write failed after a lost OACK: %v", err)
+	}
+	//repeated ACKs are ignored, only the server resends the block
+	atomic.StoreInt32(&drop, int32(OPCODE_DATA))
+	received := new(bytes.Buffer)
+	_, err = client.Get("sub-second-timeout", received)
+	if err != nil {
+		t.Fatalf("Read failed after a lost block: %v", err)
+	} else if !bytes.Equal(received.Bytes(), data) {
+		t.Fatalf("Read %d of %d bytes", received.Len(), len(data))
+	}
+	if atomic.LoadInt32(&drop) != 0 {
+		t.Fatalf("Block was not dropped")
 	}
-	defer mutex.Unlock()
 }
 
-//function sender uses to send data to receiver
-func handleRead(filename string, w *io.PipeWriter) {
+//transfers with several blocks in flight, including windows cut short by the end of the file
+func TestWindowSize(t *testing.T) {
+	client := &Client{RemoteAddr: c.RemoteAddr, Transport: network, Log: c.Log, WindowSize: 4}
+	writeAndRead(t, client, "windowsize-4", bytes.Repeat([]byte("window"), 1000))
+	writeAndRead(t, client, "windowsize-boundary", bytes.Repeat([]byte("w"), BLOCK_SIZE*8))
+	accepted := s.negotiate(map[string]string{OPTION_WINDOWSIZE: "1000"}, -1, false)
+	if accepted[OPTION_WINDOWSIZE] != strconv.Itoa(DEFAULT_MAX_WINDOW_SIZE) {
+		t.Fatalf("Expected window size %d, got %v", DEFAULT_MAX_WINDOW_SIZE, accepted)
+	}
+}
+
+//lost blocks are resent starting after the last block that was acknowledged
+func TestWindowSizeLoss(t *testing.T) {
+	dataPackets := 0
+	p := newProxy(t, func(packet []byte) bool {
+		if binary.BigEndian.Uint16(packet) != OPCODE_DATA {
+			return false
+		}
+		dataPackets++
+		return dataPackets % 7 == 0
+	})
+	defer p.Close()
+	client := &Client{RemoteAddr: p.Addr(), Transport: network, Log: c.Log, WindowSize: 4, Timeout: time.Second}
+	writeAndRead(t, client, "windowsize-loss", bytes.Repeat([]byte("lossy"), 2000))
+}
+
+//a block that arrives after the sender gave up waiting is resent once and both copies are
+//acknowledged. The duplicate ACK must not make the sender resend the next block, or every block
+//from then on would be sent twice (Sorcerer's Apprentice syndrome)
+func TestSorcerersApprentice(t *testing.T) {
+	forgetFiles(t)
+	data := bytes.Repeat([]byte("apprentice"), BLOCK_SIZE*6)//60 full blocks
+	blocks := len(data)/BLOCK_SIZE + 1
+	for i, test := range []struct {
+		name 		string
+		timeout 	time.Duration//of the client. The server uses it rounded up to whole seconds
+		every 		int//every how many DATA packets one arrives late
+	}{{"apprentice-write", 100*time.Millisecond, 10}, {"apprentice-read", time.Second, 30}} {
+		dataPackets, late := 0, 0
+		p := newDelayProxy(t, func(packet []byte) time.Duration {
+			if binary.BigEndian.Uint16(packet) != OPCODE_DATA {
+				return 0
+			}
+			dataPackets++
+			if dataPackets % test.every != 0 {
+				return 0
+			}
+			late++
+			//arrive after the sender resent the block
+			return test.timeout * 3 / 2
+		})
+		client := &Client{RemoteAddr: p.Addr(), Transport: network, Log: c.Log, Timeout: test.timeout}
+		var stored []byte
+		var err error
+		if i == 0 {
+			_, err = client.Put(test.name, bytes.NewReader(data))
+			mutex.Lock()
+			stored = m[test.name]
+			mutex.Unlock()
+		} else {
+			mutex.Lock()
+			m[test.name] = data
+			mutex.Unlock()
+			received := new(bytes.Buffer)
+			_, err = client.Get(test.name, received)
+			stored = received.Bytes()
+		}
+		p.Close()
+		if err != nil || !bytes.Equal(stored, data) {
+			t.Fatalf("%s: transferred %d of %d bytes: %v", test.name, len(stored), len(data), err)
+		}
+		p.mutex.Lock()
+		sent, resent := dataPackets, late
+		p.mutex.Unlock()
+		//each late block costs one resend. Leave a little room for timeouts on a busy machine
+		if sent > blocks + resent + 2 {
+			t.Fatalf("%s: %d DATA packets for %d blocks with %d late ones", test.name, sent, blocks, resent)
+		}
+		if resent == 0 {
+			t.Fatalf("%s: no packet was delayed", test.name)
+		}
+	}
+}
+
+//adaptive timeouts follow the round trip time, back off on every resend and ignore
+//answers to resent packets
+func TestRetransmitTimer(t *testing.T) {
+	fixed := newRetransmitTimer(time.Second, 2, false, 0, 0)
+	fixed.sent(true)
+	fixed.answered()
+	if fixed.expired() || fixed.timeout() != time.Second || !fixed.expired() {
+		t.Fatalf("Fixed timeout changed or did not give up after 2 attempts: %v", fixed.timeout())
+	}
+
+	timer := newRetransmitTimer(time.Second, 2, true, 10*time.Millisecond, 4*time.Second)
+	for i := 0; i < 10; i++ {
+		timer.sent(true)
+		time.Sleep(time.Millisecond)
+		timer.answered()
+	}
+	fast := timer.timeout()
+	if fast != 10*time.Millisecond {
+		t.Fatalf("Expected the shortest timeout after fast answers, got %v", fast)
+	}
+	//backs off up to the longest timeout, and gives up only once as much time passed as 2 fixed timeouts
+	var waited time.Duration
+	for i := 1; waited < 2*time.Second; i++ {
+		timer.sent(i == 1)
+		waited += timer.timeout()
+		if timer.expired() != (waited >= 2*time.Second) {
+			t.Fatalf("Gave up too early or too late after %d attempts and %v", i, waited)
+		}
+		if expected := min(fast << i, 4*time.Second); timer.timeout() != expected {
+			t.Fatalf("Expected %v after %d timeouts, got %v", expected, i, timer.timeout())
+		}
+	}
+	for timer.timeout() < 4*time.Second {
+		timer.expired()
+	}
+	//the answer could be to any of the resent packets, so it is not measured
+	timer.answered()
+	if timer.timeout() != 4*time.Second {
+		t.Fatalf("Answer to a resent packet changed the timeout to %v", timer.timeout())
+	}
+	timer.sent(true)
+	time.Sleep(time.Millisecond)
+	timer.answered()
+	if timer.timeout() >= 4*time.Second {
+		t.Fatalf("Timeout did not adapt after a new measurement: %v", timer.timeout())
+	}
+	if checkAdaptiveTimeouts(time.Second, time.Millisecond) == nil || checkAdaptiveTimeouts(-1, 0) == nil {
+		t.Fatalf("Invalid timeout bounds accepted")
+	}
+}
+
+//lost packets are resent after about a round trip instead of after seconds
+func TestAdaptiveTimeout(t *testing.T) {
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, AdaptiveTimeout: true, Transport: network}
+	addr := startServer(t, server)
+	defer server.Close()
+	dataPackets := 0
+	p := startProxy(t, &proxy{server: addr, drop: func(packet []byte) bool {
+		if binary.BigEndian.Uint16(packet) != OPCODE_DATA {
+			return false
+		}
+		dataPackets++
+		return dataPackets % 10 == 0
+	}})
+	defer p.Close()
+	client := &Client{RemoteAddr: p.Addr(), Transport: network, Log: c.Log, AdaptiveTimeout: true}
+	start := time.Now()
+	writeAndRead(t, client, "adaptive-timeout", bytes.Repeat([]byte("adaptive"), BLOCK_SIZE*4))//33 blocks each way
+	if elapsed := time.Since(start); elapsed > DEFAULT_SEND_TIMEOUT {
+		t.Fatalf("Recovering from %d lost blocks took %v", dataPackets/10, elapsed)
+	}
+}
+
+//block numbers wrap around after 65535 to 0 or 1
+func TestBlockNumbers(t *testing.T) {
+	for _, test := range []struct {
+		block 		int64
+		rollover 	uint16
+		num 		uint16
+	}{{1, 0, 1}, {65535, 0, 65535}, {65536, 0, 0}, {65537, 0, 1}, {131072, 0, 0},
+		{1, 1, 1}, {65535, 1, 65535}, {65536, 1, 1}, {65537, 1, 2}, {131070, 1, 65535}, {131071, 1, 1}} {
+		if num := blockNumber(test.block, test.rollover); num != test.num {
+			t.Fatalf("Block %d with rollover %d: expected #%d, got #%d", test.block, test.rollover, test.num, num)
+		}
+		if distance := blockDistance(test.block-1, test.num, test.rollover); distance != 1 {
+			t.Fatalf("Block %d with rollover %d: #%d is %d blocks ahead", test.block, test.rollover, test.num, distance)
+		}
+		if distance := blockDistance(test.block, test.num, test.rollover); distance != 0 {
+			t.Fatalf("Block %d with rollover %d: #%d is %d blocks ahead", test.block, test.rollover, test.num, distance)
+		}
+	}
+}
+
+//transfers of more than 65535 blocks with both rollover conventions
+func TestRollover(t *testing.T) {
+	quiet := log.New(io.Discard, "", 0)
+	data := bytes.Repeat([]byte("rollover"), 70000)//more blocks than fit in 16 bits with 8 byte blocks
+	for _, rollover := range []uint16{0, 1} {
+		server := &Server{ReadHandler: memory, WriteHandler: memory, Log: quiet, Rollover: rollover, Transport: network}
+		addr := startServer(t, server)
+		defer server.Close()
+		for _, window := range []int{1, 16} {
+			client := &Client{RemoteAddr: addr, Log: quiet, BlockSize: MIN_BLOCK_SIZE, WindowSize: window, Rollover: rollover, Transport: network}
+			writeAndRead(t, client, fmt.Sprintf("rollover-%d-window-%d", rollover, window), data)
+		}
+	}
+}
+
+//netascii files are sent with CR LF line endings and read back as written
+func TestNetascii(t *testing.T) {
+	forgetFiles(t)
+	filename := "netascii-file"
+	text := "first line\nwindows line\r\nbare\rcarriage return\r"
+	err := c.WriteFile(filename, MODE_NETASCII, func(w *io.PipeWriter) {
+		w.Write([]byte(text))
+		w.Close()
+	})
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", filename, err)
+	}
 	mutex.Lock()
-	data, exists := m[filename]
-	if exists {
-		buffer := bytes.NewBuffer(data)
-		datalength, err := buffer.WriteTo(w)
+	stored := string(m[filename])
+	mutex.Unlock()
+	if stored != text {
+		t.Fatalf("sent: %q, stored: %q", text, stored)
+	}
+	returnBuffer := new(bytes.Buffer)
+	err = c.ReadFile(filename, "NetASCII", func(r *io.PipeReader) {
+		returnBuffer.ReadFrom(r)
+	})
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", filename, err)
+	}
+	if returnBuffer.String() != text {
+		t.Fatalf("sent: %q, received: %q", text, returnBuffer.String())
+	}
+	//line endings are translated on the wire
+	wire := new(bytes.Buffer)
+	p := newProxy(t, func(packet []byte) bool {
+		if binary.BigEndian.Uint16(packet) == OPCODE_DATA {
+			wire.Write(packet[4:])
+		}
+		return false
+	})
+	defer p.Close()
+	client := &Client{RemoteAddr: p.Addr(), Transport: network, Log: c.Log}
+	err = client.ReadFile(filename, MODE_NETASCII, func(r *io.PipeReader) {
+		io.Copy(io.Discard, r)
+	})
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", filename, err)
+	}
+	encoded := "first line\r\nwindows line\r\x00\r\nbare\r\x00carriage return\r\x00"
+	p.mutex.Lock()
+	sent := wire.String()
+	p.mutex.Unlock()
+	if sent != encoded {
+		t.Fatalf("expected: %q, sent: %q", encoded, sent)
+	}
+
+	//sizes on the wire are not known up front, so none are sent
+	if _, err := c.FileSize(filename, MODE_NETASCII); err != ERR_NO_TRANSFER_SIZE {
+		t.Fatalf("Expected no transfer size, got %v", err)
+	}
+	announced := false
+	p = newProxy(t, func(packet []byte) bool {
+		if request, err := UnPack(packet); err == nil {
+			if wrq, ok := request.(*WRQ); ok {
+				_, announced = wrq.Options[OPTION_TSIZE]
+			}
+		}
+		return false
+	})
+	defer p.Close()
+	client = &Client{RemoteAddr: p.Addr(), Transport: network, Log: c.Log}
+	err = client.WriteFileSize("netascii-size", MODE_NETASCII, int64(len(text)), func(w *io.PipeWriter) {
+		w.Write([]byte(text))
+		w.Close()
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if announced {
+		t.Fatalf("Size of a netascii file was announced")
+	}
+}
+
+//CR LF pairs split across writes and reads are still translated
+func TestNetasciiTranslation(t *testing.T) {
+	text := strings.Repeat("line\n\r", BLOCK_SIZE)
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(iotest.OneByteReader(newNetasciiReader(strings.NewReader(text))))
+	if encoded.String() != strings.Repeat("line\r\n\r\x00", BLOCK_SIZE) {
+		t.Fatalf("Encoded incorrectly: %q", encoded.String()[:32])
+	}
+	decoded := new(bytes.Buffer)
+	writer := newNetasciiWriter(decoded)
+	for _, c := range encoded.Bytes() {
+		writer.Write([]byte{c})
+	}
+	writer.Flush()
+	if decoded.String() != text {
+		t.Fatalf("Decoded incorrectly: %q", decoded.String()[:32])
+	}
+}
+
+//server refuses modes it does not support
+func TestUnsupportedMode(t *testing.T) {
+	_, err := c.FileSize("first-write", "mail")
+	if err == nil || !strings.Contains(err.Error(), "mail") {
+		t.Fatalf("Expected unsupported mode error, got %v", err)
+	}
+}
+
+//-------------------------------------------------------------------------------------------------------
+//proxy sits between a client and the test server so tests can drop or delay packets.
+//It relays a single client at a time and follows the server to its transfer port.
+//Proxies run on the memory network
+//-------------------------------------------------------------------------------------------------------
+
+type proxy struct {
+	clientConn 	net.PacketConn//socket the client talks to
+	serverConn 	net.PacketConn//socket the server talks to
+	drop 		func(packet []byte) bool//decides whether a packet is lost. Called from one goroutine at a time
+	delay 		func(packet []byte) time.Duration//decides how late a packet arrives. Called like drop
+	server 		*net.UDPAddr//server to relay to. nil relays to the test server
+	mutex 		sync.Mutex
+	clientAddr 	*net.UDPAddr
+	serverAddr 	*net.UDPAddr
+}
+
+func newProxy(t *testing.T, drop func(packet []byte) bool) *proxy {
+	return startProxy(t, &proxy{drop: drop})
+}
+
+//proxy that holds packets back instead of dropping them, so they arrive late and out of order
+func newDelayProxy(t *testing.T, delay func(packet []byte) time.Duration) *proxy {
+	return startProxy(t, &proxy{delay: delay})
+}
+
+func startProxy(t *testing.T, p *proxy) *proxy {
+	clientConn, err := network.ListenPacket(nil)
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	serverConn, err := network.ListenPacket(nil)
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	p.clientConn, p.serverConn = clientConn, serverConn
+	if p.server == nil {
+		p.server = s.BindAddr
+	}
+	go p.relay(clientConn, serverConn, true)
+	go p.relay(serverConn, clientConn, false)
+	return p
+}
+
+func (p *proxy) Addr() *net.UDPAddr {
+	return p.clientConn.LocalAddr().(*net.UDPAddr)
+}
+
+func (p *proxy) Close() {
+	p.clientConn.Close()
+	p.serverConn.Close()
+}
+
+//copies packets from one socket to the other until the proxy is closed
+func (p *proxy) relay(from net.PacketConn, to net.PacketConn, fromClient bool) {
+	buffer := make([]byte, MAX_BLOCK_SIZE+4)
+	for {
+		n, sender, err := from.ReadFrom(buffer)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to send %s: %v", filename, err)
+			return
+		}
+		addr := sender.(*net.UDPAddr)
+		p.mutex.Lock()
+		var dest *net.UDPAddr
+		if fromClient {
+			opcode := binary.BigEndian.Uint16(buffer)
+			if p.clientAddr == nil || opcode == OPCODE_RRQ || opcode == OPCODE_WRQ {
+				//new transfer starts at the server's listening port
+				p.clientAddr, p.serverAddr = addr, p.server
+			}
+			dest = p.serverAddr
+		} else {
+			p.serverAddr = addr
+			dest = p.clientAddr
+		}
+		dropped := p.drop != nil && p.drop(buffer[:n])
+		var delay time.Duration
+		if p.delay != nil {
+			delay = p.delay(buffer[:n])
+		}
+		p.mutex.Unlock()
+		if dropped {
+			continue
+		} else if delay > 0 {
+			late := append([]byte(nil), buffer[:n]...)
+			time.AfterFunc(delay, func() {
+				to.WriteTo(late, dest)
+			})
 		} else {
-			fmt.Fprintf(os.Stderr, "Sent %s (%d bytes)", filename, datalength)
+			to.WriteTo(buffer[:n], dest)
 		}
+	}
+}
+
+//errors chosen by the server's handlers reach the client with their codes
+func TestErrorCodes(t *testing.T) {
+	forgetFiles(t)
+	var tftpErr *TFTPError
+	err := c.ReadFile("error-missing", TRANSFER_MODE, func(r *io.PipeReader) {
+		io.Copy(io.Discard, r)
+	})
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_FILE_NOT_FOUND {
+		t.Fatalf("Expected file not found, got %v", err)
+	}
+	writeAndRead(t, c, "error-exists", []byte("written once"))
+	err = c.WriteFile("error-exists", TRANSFER_MODE, func(w *io.PipeWriter) {
+		w.Write([]byte("written twice"))
 		w.Close()
-	} else {
-		w.CloseWithError(fmt.Errorf("File not found: %s", filename))
+	})
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_FILE_EXISTS {
+		t.Fatalf("Expected file already exists, got %v", err)
+	}
+	_, err = c.FileSize("error-mode", "mail")
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_ILLEGAL_OPERATION {
+		t.Fatalf("Expected illegal operation, got %v", err)
+	}
+	err = c.WriteFileSize("error-size", TRANSFER_MODE, MAX_FILE_SIZE+1, func(w *io.PipeWriter) {
+		w.Close()
+	})
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_DISK_FULL {
+		t.Fatalf("Expected disk full, got %v", err)
+	}
+}
+
+//handlers refuse requests with the first reply, sent from the server's own port
+func TestHandlerRefusal(t *testing.T) {
+	server := &Server{ReadHandler: ReadHandlerFunc(func(r *Request) (io.WriterTo, error) {
+		return nil, os.ErrNotExist
+	}), Log: s.Log}
+	addr := startServer(t, server)
+	defer server.Close()
+	conn, err := net.ListenUDP(UDP_NET, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to open socket: %v", err)
+	}
+	defer conn.Close()
+	requests := map[uint16][]byte{
+		ERROR_FILE_NOT_FOUND: (&RRQ{"refused-read", TRANSFER_MODE, nil}).Pack(),
+		ERROR_ACCESS_VIOLATION: (&WRQ{"refused-write", TRANSFER_MODE, nil}).Pack(),
+	}
+	for code, request := range requests {
+		conn.WriteToUDP(request, addr)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buffer := make([]byte, MAX_DATAGRAM_SIZE)
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("No reply to refused request: %v", err)
+		}
+		if from.Port != addr.Port {
+			t.Fatalf("Refusal sent from port %d instead of %d", from.Port, addr.Port)
+		}
+		packet, err := UnPack(buffer[:n])
+		if errPacket, ok := packet.(*ERROR); !ok || errPacket.ErrCode != code {
+			t.Fatalf("Expected ERROR %d, got %v (%v)", code, packet, err)
+		}
+	}
+}
+
+//transfers stop promptly once their context is done
+func TestContextCancel(t *testing.T) {
+	forgetFiles(t)
+	//nothing is resent once the transfer is cancelled
+	var requests int32
+	counting := &MemoryNetwork{Drop: func(packet []byte, from net.Addr, to net.Addr) bool {
+		if binary.BigEndian.Uint16(packet) == OPCODE_RRQ {
+			atomic.AddInt32(&requests, 1)
+		}
+		return false
+	}}
+	//packets are only handed to Drop if someone listens, so listen without ever answering
+	silent, err := counting.ListenPacket(nobody)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer silent.Close()
+	client := &Client{RemoteAddr: nobody, Transport: counting, Log: c.Log, Timeout: 5*time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = client.ReadFileContext(ctx, "context-deadline", TRANSFER_MODE, func(r *io.PipeReader) {
+		io.Copy(io.Discard, r)
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Took %v to give up", elapsed)
+	}
+	if sent := atomic.LoadInt32(&requests); sent != 1 {
+		t.Fatalf("Sent %d read requests", sent)
+	}
+
+	//cancel a write halfway through while the handler is still producing data
+	//the second ACK is late, so the client is waiting for it instead of reading more data when it is cancelled
+	var secondBlocks int32
+	p := newDelayProxy(t, func(packet []byte) time.Duration {
+		if binary.BigEndian.Uint16(packet) == OPCODE_DATA && binary.BigEndian.Uint16(packet[2:]) == 2 {
+			atomic.AddInt32(&secondBlocks, 1)
+		}
+		if binary.BigEndian.Uint16(packet) == OPCODE_ACK && binary.BigEndian.Uint16(packet[2:]) == 2 {
+			return time.Second
+		}
+		return 0
+	})
+	defer p.Close()
+	client = &Client{RemoteAddr: p.Addr(), Transport: network, Log: c.Log}
+	ctx, cancel = context.WithCancel(context.Background())
+	var handlerErr error
+	err = client.WriteFileContext(ctx, "context-cancel", TRANSFER_MODE, func(w *io.PipeWriter) {
+		w.Write(bytes.Repeat([]byte("x"), BLOCK_SIZE*2))
+		time.AfterFunc(200*time.Millisecond, cancel)
+		_, handlerErr = w.Write([]byte("never sent"))
+	})
+	if err != context.Canceled {
+		t.Fatalf("Expected cancellation, got %v", err)
+	}
+	if handlerErr == nil {
+		t.Fatalf("Handler could keep writing after cancellation")
+	}
+	//server was told to abort and keeps nothing
+	time.Sleep(100*time.Millisecond)
+	mutex.Lock()
+	_, exists := m["context-cancel"]
+	mutex.Unlock()
+	if exists {
+		t.Fatalf("Cancelled file was stored")
+	} else if sent := atomic.LoadInt32(&secondBlocks); sent != 1 {
+		t.Fatalf("Sent block 2 %d times", sent)
 	}
+}
+
+//files are streamed to and from the server without handlers
+func TestOpenCreate(t *testing.T) {
+	forgetFiles(t)
+	data := bytes.Repeat([]byte("stream"), 500)
+	file, err := c.Create("stream-file")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	file.Write(data[:1000])
+	file.Write(data[1000:])
+	if err = file.Close(); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	reader, err := c.Open("stream-file")
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	received, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(data, received) {
+		t.Fatalf("Read %d of %d bytes: %v", len(received), len(data), err)
+	}
+
+	//errors reach the caller where they happen
+	var tftpErr *TFTPError
+	if _, err = c.Open("stream-missing"); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_FILE_NOT_FOUND {
+		t.Fatalf("Expected file not found, got %v", err)
+	}
+	file, _ = c.Create("stream-file")
+	file.Write([]byte("written twice"))
+	if err = file.Close(); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_FILE_EXISTS {
+		t.Fatalf("Expected file already exists, got %v", err)
+	}
+
+	//closing a file early aborts the transfer instead of waiting for the rest
+	reader, err = c.Open("stream-file")
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	reader.Read(make([]byte, 10))
+	done := make(chan struct{})
+	go func() {
+		reader.Close()
+		close(done)
+	}()
+	select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("Close did not abort the transfer")
+	}
+
+	//a created file is locked until it is closed
+	file, err = c.Create("stream-locked")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	file.Write([]byte("locked"))
+	opened := make(chan error, 1)
+	go func() {
+		reader, err := c.Open("stream-locked")
+		if err == nil {
+			reader.Close()
+		}
+		opened <- err
+	}()
+	select {
+		case err := <-opened:
+			t.Fatalf("File was opened while it was being created: %v", err)
+		case <-time.After(100*time.Millisecond):
+	}
+	if err = file.Close(); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err = <-opened; err != nil {
+		t.Fatalf("Failed to open file once it was closed: %v", err)
+	}
+}
+
+//Get and Put copy whole files and count the bytes
+func TestGetPut(t *testing.T) {
+	forgetFiles(t)
+	data := bytes.Repeat([]byte("put"), 1000)
+	written, err := c.Put("get-put", bytes.NewReader(data))
+	if err != nil || written != int64(len(data)) {
+		t.Fatalf("Put %d of %d bytes: %v", written, len(data), err)
+	}
+	buffer := new(bytes.Buffer)
+	read, err := c.Get("get-put", buffer)
+	if err != nil || read != int64(len(data)) || !bytes.Equal(data, buffer.Bytes()) {
+		t.Fatalf("Got %d of %d bytes: %v", read, len(data), err)
+	}
+	//the announced size lets the server refuse the file up front
+	_, err = c.Put("get-put-large", bytes.NewReader(make([]byte, MAX_FILE_SIZE+1)))
+	var tftpErr *TFTPError
+	if !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_DISK_FULL {
+		t.Fatalf("Expected disk full, got %v", err)
+	}
+	_, err = c.Put("get-put-failed", iotest.ErrReader(errors.New("broken source")))
+	if err == nil {
+		t.Fatalf("Failed source was not reported")
+	}
+}
+
+//the announced size of a stream is what is left of it
+func TestStreamSize(t *testing.T) {
+	reader := bytes.NewReader([]byte("partly read"))
+	reader.Read(make([]byte, 7))
+	if size := streamSize(reader); size != 4 {
+		t.Fatalf("Expected 4 bytes left in reader, got %d", size)
+	}
+	if size := streamSize(strings.NewReader("string")); size != 6 {
+		t.Fatalf("Expected 6 bytes in string, got %d", size)
+	}
+	file, err := os.Create(filepath.Join(t.TempDir(), "stream-size"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+	file.WriteString("partly read")
+	file.Seek(7, io.SeekStart)
+	if size := streamSize(file); size != 4 {
+		t.Fatalf("Expected 4 bytes left in file, got %d", size)
+	}
+	if size := streamSize(iotest.ErrReader(io.EOF)); size != -1 {
+		t.Fatalf("Expected unknown size, got %d", size)
+	}
+}
+
+//files are served from a directory and nothing outside of it can be reached
+func TestFileServer(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("outside"), 0644)
+	os.Mkdir(filepath.Join(dir, "configs"), 0755)
+	os.Mkdir(filepath.Join(dir, "folder"), 0755)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "escape"))
+	handler := &FileServer{Dir: dir}
+	server := &Server{ReadHandler: handler, WriteHandler: handler, Log: s.Log}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log}
+	defer server.Close()
+
+	data := bytes.Repeat([]byte("config"), 200)
+	if _, err := client.Put("configs\\router.cfg", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, "configs", "router.cfg"))
+	if err != nil || !bytes.Equal(data, stored) {
+		t.Fatalf("File was not stored in the directory: %v", err)
+	}
+	buffer := new(bytes.Buffer)
+	if _, err = client.Get("configs/router.cfg", buffer); err != nil || !bytes.Equal(data, buffer.Bytes()) {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if size, err := client.FileSize("configs/router.cfg", TRANSFER_MODE); size != int64(len(data)) {
+		t.Fatalf("Expected size %d, got %d: %v", len(data), size, err)
+	}
+
+	refused := map[string]uint16{
+		"missing": ERROR_FILE_NOT_FOUND,
+		"../secret": ERROR_ACCESS_VIOLATION,
+		"configs/../../secret": ERROR_ACCESS_VIOLATION,
+		"/etc/passwd": ERROR_ACCESS_VIOLATION,
+		"escape": ERROR_ACCESS_VIOLATION,
+		"folder": ERROR_ACCESS_VIOLATION,
+	}
+	var tftpErr *TFTPError
+	for filename, code := range refused {
+		_, err = client.Get(filename, io.Discard)
+		if !errors.As(err, &tftpErr) || tftpErr.Code != code {
+			t.Fatalf("Expected error %d reading %s, got %v", code, filename, err)
+		}
+	}
+	if _, err = client.Put("../written", strings.NewReader("outside")); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_ACCESS_VIOLATION {
+		t.Fatalf("Expected access violation, got %v", err)
+	}
+
+	handler.ReadOnly = true
+	if _, err = client.Put("read-only", strings.NewReader("refused")); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_ACCESS_VIOLATION {
+		t.Fatalf("Expected access violation, got %v", err)
+	}
+}
+
+//a failed write leaves the old file in place and nothing else behind
+func TestFileServerAtomicWrite(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "config"), []byte("old config"), 0644)
+	handler := &FileServer{Dir: dir}
+	server := &Server{ReadHandler: handler, WriteHandler: handler, Log: s.Log}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log}
+	defer server.Close()
+
+	source := io.MultiReader(bytes.NewReader(make([]byte, BLOCK_SIZE*3)), iotest.ErrReader(errors.New("connection lost")))
+	if _, err := client.Put("config", source); err == nil {
+		t.Fatalf("Failed write was not reported")
+	}
+	for i := 0; ; i++ {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) == 1 {
+			break
+		} else if i == 100 {
+			t.Fatalf("Partial upload was left behind: %v", entries)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	if stored, _ := os.ReadFile(filepath.Join(dir, "config")); string(stored) != "old config" {
+		t.Fatalf("Failed write changed the file: %s", stored)
+	}
+
+	if _, err := client.Put("config", strings.NewReader("new config")); err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+	//the write only succeeds once the file has been replaced
+	if stored, _ := os.ReadFile(filepath.Join(dir, "config")); string(stored) != "new config" {
+		t.Fatalf("File was not replaced: %s", stored)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("Temporary file was left behind: %v", entries)
+	}
+
+	//temporary files can not be reached by clients, even while an upload is running
+	release := make(chan struct{})
+	uploaded := make(chan error, 1)
+	go func() {
+		uploaded <- client.WriteFile("config", TRANSFER_MODE, func(w *io.PipeWriter) {
+			w.Write(make([]byte, BLOCK_SIZE*2))
+			<-release
+			w.Close()
+		})
+	}()
+	var temp string
+	for i := 0; temp == ""; i++ {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if entry.Name() != "config" {
+				temp = entry.Name()
+			}
+		}
+		if i == 100 {
+			t.Fatalf("Upload was not staged")
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	var tftpErr *TFTPError
+	if _, err := client.Get(temp, io.Discard); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_ACCESS_VIOLATION {
+		t.Fatalf("Expected access violation reading %s, got %v", temp, err)
+	}
+	if _, err := client.Put(temp, strings.NewReader("raced")); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_ACCESS_VIOLATION {
+		t.Fatalf("Expected access violation writing %s, got %v", temp, err)
+	}
+	close(release)
+	if err := <-uploaded; err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+	//other names starting with a dot are still served
+	writeAndRead(t, client, ".config.tftp", []byte("hidden"))
+}
+
+//writes are refused up front according to the server's write policy
+func TestWritePolicy(t *testing.T) {
+	forgetFiles(t)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "existing"), []byte("existing"), 0644)
+	handler := &FileServer{Dir: dir}
+	server := &Server{ReadHandler: handler, WriteHandler: handler, Log: s.Log}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log}
+	defer server.Close()
+
+	//error sent for a new and an existing file, 0 if the write is allowed
+	policies := map[WritePolicy][2]uint16{
+		WRITE_ANY: {0, 0},
+		WRITE_DENY: {ERROR_ACCESS_VIOLATION, ERROR_ACCESS_VIOLATION},
+		WRITE_CREATE: {0, ERROR_FILE_EXISTS},
+		WRITE_REPLACE: {ERROR_FILE_NOT_FOUND, 0},
+	}
+	for policy, codes := range policies {
+		server.WritePolicy = policy
+		for i, filename := range []string{fmt.Sprintf("new-%d", policy), "existing"} {
+			_, err := client.Put(filename, strings.NewReader("policy"))
+			var tftpErr *TFTPError
+			if codes[i] == 0 && err != nil {
+				t.Fatalf("Policy %d refused to write %s: %v", policy, filename, err)
+			} else if codes[i] != 0 && (!errors.As(err, &tftpErr) || tftpErr.Code != codes[i]) {
+				t.Fatalf("Policy %d: expected error %d writing %s, got %v", policy, codes[i], filename, err)
+			}
+		}
+	}
+
+	//policies that need to know about existing files need a handler that can tell
+	server = &Server{WriteHandler: WriteHandlerFunc(func(r *Request) (io.ReaderFrom, error) {
+		return &memoryFile{name: r.FileName}, nil
+	}), WritePolicy: WRITE_CREATE}
+	if err := server.Startup(); err == nil {
+		t.Fatalf("Server started with a write policy it can not enforce")
+	}
+}
+
+//a write succeeds even if the ACK of its last block is lost
+//the server acknowledges the repeated block instead of having the client fail a stored file
+func TestLostLastAck(t *testing.T) {
+	forgetFiles(t)
+	for _, singlePort := range []bool{false, true} {
+		lossy := &MemoryNetwork{}
+		var dropped int32
+		lossy.Drop = func(packet []byte, from net.Addr, to net.Addr) bool {
+			//600 bytes are blocks 1 and 2
+			return binary.BigEndian.Uint16(packet) == OPCODE_ACK && binary.BigEndian.Uint16(packet[2:]) == 2 && atomic.CompareAndSwapInt32(&dropped, 0, 1)
+		}
+		server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, Transport: lossy, WritePolicy: WRITE_CREATE, SinglePort: singlePort}
+		addr := startServer(t, server)
+		client := &Client{RemoteAddr: addr, Log: c.Log, Transport: lossy, Timeout: 200*time.Millisecond}
+		filename := fmt.Sprintf("lost-last-ack-%v", singlePort)
+		data := bytes.Repeat([]byte("a"), 600)
+		_, err := client.Put(filename, bytes.NewReader(data))
+		server.Close()
+		if atomic.LoadInt32(&dropped) != 1 {
+			t.Fatalf("Last ACK was not dropped")
+		} else if err != nil {
+			t.Fatalf("Write failed although the file was stored (single port %v): %v", singlePort, err)
+		}
+		mutex.Lock()
+		stored := m[filename]
+		mutex.Unlock()
+		if !bytes.Equal(stored, data) {
+			t.Fatalf("Stored %d of %d bytes", len(stored), len(data))
+		}
+	}
+}
+
+//any fs.FS can be served for reads
+func TestFileServerFS(t *testing.T) {
+	handler := &FileServer{FS: fstest.MapFS{"boot/image": {Data: []byte("boot image")}}}
+	server := &Server{ReadHandler: handler, WriteHandler: handler, Log: s.Log}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log}
+	defer server.Close()
+	buffer := new(bytes.Buffer)
+	if _, err := client.Get("boot/image", buffer); err != nil || buffer.String() != "boot image" {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	var tftpErr *TFTPError
+	if _, err := client.Put("boot/image", strings.NewReader("replaced")); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_ACCESS_VIOLATION {
+		t.Fatalf("Expected access violation, got %v", err)
+	}
+}
+
+//transfer sockets stay within the configured port ranges
+func TestTransferPorts(t *testing.T) {
+	clientPorts := make(chan int, 1)
+	release := make(chan struct{})
+	server := &Server{ReadHandler: ReadHandlerFunc(func(r *Request) (io.WriterTo, error) {
+		clientPorts <- r.RemoteAddr.Port
+		return waitingFile(release), nil
+	}), Log: s.Log, TransferIP: net.IPv4(127, 0, 0, 1), TransferPorts: PortRange{3020, 3020}, Transport: network}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log, TransferPorts: PortRange{3021, 3022}, Transport: network}
+	defer server.Close()
+
+	//server answers from its only transfer port
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.Get("ports", io.Discard)
+		read <- err
+	}()
+	if port := <-clientPorts; port != 3021 && port != 3022 {
+		t.Fatalf("Client used port %d outside of its range", port)
+	}
+	time.Sleep(100*time.Millisecond)//let the transfer start
+	//the server's only transfer port is taken by the first read
+	_, err := client.Get("ports", io.Discard)
+	<-clientPorts
+	if err == nil || !strings.Contains(err.Error(), ERR_NO_FREE_PORT.Error()) {
+		t.Fatalf("Expected the server to run out of ports, got %v", err)
+	}
+	close(release)
+	if err := <-read; err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	//the client's ports are all taken
+	taken, err := network.ListenPacket(&net.UDPAddr{Port: 3023})
+	if err != nil {
+		t.Fatalf("Failed to take port: %v", err)
+	}
+	defer taken.Close()
+	client.TransferPorts = PortRange{3023, 3023}
+	if _, err := client.Get("ports", io.Discard); !errors.Is(err, ERR_NO_FREE_PORT) {
+		t.Fatalf("Expected no free port, got %v", err)
+	}
+	client.TransferPorts = PortRange{3024, 3023}
+	if _, err := client.Get("ports", io.Discard); err == nil {
+		t.Fatalf("Invalid port range accepted")
+	}
+}
+
+//all transfers run on the listening port in single port mode
+func TestSinglePort(t *testing.T) {
+	forgetFiles(t)
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, SinglePort: true}
+	addr := startServer(t, server)
+	client := &Client{RemoteAddr: addr, Log: c.Log, BlockSize: 1428, WindowSize: 4}
+	writeAndRead(t, client, "single-port", bytes.Repeat([]byte("single"), 2000))
+
+	//several transfers at once, each with its own client port
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			_, err := client.Put(fmt.Sprintf("single-port-%d", i), bytes.NewReader(bytes.Repeat([]byte{byte(i)}, 5000)))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Concurrent write failed: %v", err)
+		}
+	}
+
+	//data comes from the listening port
+	conn, _ := net.ListenUDP(UDP_NET, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer conn.Close()
+	conn.WriteToUDP((&RRQ{"single-port", TRANSFER_MODE, nil}).Pack(), addr)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	n, from, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatalf("No data received: %v", err)
+	}
+	if packet, _ := UnPack(buffer[:n]); from.Port != addr.Port {
+		t.Fatalf("%v sent from port %d instead of %d", packet, from.Port, addr.Port)
+	}
+	conn.WriteToUDP((&ERROR{ERROR_UNDEFINED, "done"}).Pack(), addr)
+
+	//running transfers keep the port open through a shutdown
+	release := make(chan struct{})
+	written := make(chan error, 1)
+	go func() {
+		written <- client.WriteFile("single-port-shutdown", TRANSFER_MODE, func(w *io.PipeWriter) {
+			w.Write(bytes.Repeat([]byte("s"), 2000))
+			<-release
+			w.Close()
+		})
+	}()
+	time.Sleep(100*time.Millisecond)//let the transfer start
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(100*time.Millisecond)
+	close(release)
+	if err := <-written; err != nil {
+		t.Fatalf("Transfer was cut off by the shutdown: %v", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+}
+
+//requests beyond the transfer limit are refused as busy
+func TestMaxTransfers(t *testing.T) {
+	release := make(chan struct{})
+	server := &Server{ReadHandler: ReadHandlerFunc(func(r *Request) (io.WriterTo, error) {
+		if r.FileName == "waiting" {
+			return waitingFile(release), nil
+		}
+		return strings.NewReader("not waiting"), nil
+	}), Log: s.Log, MaxTransfers: 1}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log}
+	defer server.Close()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := client.Get("waiting", io.Discard)
+		read <- err
+	}()
+	time.Sleep(100*time.Millisecond)//let the transfer start
+	var tftpErr *TFTPError
+	if _, err := client.Get("busy", io.Discard); !errors.As(err, &tftpErr) || tftpErr.Message != ERR_SERVER_BUSY.Error() {
+		t.Fatalf("Expected server busy, got %v", err)
+	}
+	close(release)
+	if err := <-read; err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	time.Sleep(100*time.Millisecond)//let the server finish the transfer
+	if _, err := client.Get("busy", io.Discard); err != nil {
+		t.Fatalf("Server still busy: %v", err)
+	}
+}
 
+//a burst of clients is served at once
+func TestRequestBurst(t *testing.T) {
+	server := &Server{ReadHandler: memory, Log: s.Log, Workers: 8}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log}
+	defer server.Close()
+	writeAndRead(t, c, "burst", bytes.Repeat([]byte("boot"), 1000))
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		go func() {
+			buffer := new(bytes.Buffer)
+			_, err := client.Get("burst", buffer)
+			if err == nil && buffer.Len() != 4000 {
+				err = fmt.Errorf("Received %d bytes", buffer.Len())
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+}
+
+//a repeated request does not start a second transfer
+func TestDuplicateRequest(t *testing.T) {
+	var reads, writes atomic.Int32
+	server := &Server{ReadHandler: ReadHandlerFunc(func(r *Request) (io.WriterTo, error) {
+		reads.Add(1)
+		return strings.NewReader("duplicate"), nil
+	}), WriteHandler: WriteHandlerFunc(func(r *Request) (io.ReaderFrom, error) {
+		writes.Add(1)
+		return &memoryFile{name: "duplicate-write"}, nil
+	}), Log: s.Log}
+	addr := startServer(t, server)
+	defer server.Close()
+	requests := []Packet{&RRQ{"duplicate", TRANSFER_MODE, nil}, &WRQ{"duplicate-write", TRANSFER_MODE, nil}}
+	for _, request := range requests {
+		conn, _ := net.ListenUDP(UDP_NET, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		defer conn.Close()
+		//the client retries before it hears back
+		conn.WriteToUDP(request.Pack(), addr)
+		conn.WriteToUDP(request.Pack(), addr)
+		conn.WriteToUDP(request.Pack(), addr)
+		//every reply comes from one transfer
+		ports := map[int]bool{}
+		buffer := make([]byte, MAX_DATAGRAM_SIZE)
+		conn.SetReadDeadline(time.Now().Add(500*time.Millisecond))
+		for {
+			_, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			ports[from.Port] = true
+		}
+		if len(ports) != 1 {
+			t.Fatalf("Replies to %T came from %d transfers", request, len(ports))
+		}
+	}
+	if reads.Load() != 1 || writes.Load() != 1 {
+		t.Fatalf("Handlers called %d and %d times", reads.Load(), writes.Load())
+	}
+}
+
+//packets from anyone but the other side of a transfer are answered with ERROR 5 and ignored
+func TestUnknownTID(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		release := make(chan struct{})
+		clientAddr := make(chan *net.UDPAddr, 1)
+		server := &Server{ReadHandler: ReadHandlerFunc(func(r *Request) (io.WriterTo, error) {
+			if r.FileName == "waiting" {
+				clientAddr <- r.RemoteAddr
+				return waitingFile(release), nil
+			}
+			return memory.ServeRead(r)
+		}), Log: s.Log, SinglePort: singlePort}
+		addr := startServer(t, server)
+		defer server.Close()
+		stray, _ := net.ListenUDP(UDP_NET, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		defer stray.Close()
+		//checks that stray was told it does not belong to a transfer
+		rejected := func() {
+			buffer := make([]byte, MAX_DATAGRAM_SIZE)
+			stray.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := stray.ReadFromUDP(buffer)
+			packet, _ := UnPack(buffer[:n])
+			if errPacket, ok := packet.(*ERROR); err != nil || !ok || errPacket.ErrCode != ERROR_UNKNOWN_TID {
+				t.Fatalf("Expected unknown transfer ID, got %v (%v)", packet, err)
+			}
+		}
+
+		//in single port mode packets of transfers that do not exist are rejected by the server
+		if singlePort {
+			stray.WriteToUDP((&DATA{1, []byte("stray")}).Pack(), addr)
+			rejected()
+			stray.WriteToUDP((&ACK{1}).Pack(), addr)
+			rejected()
+		}
+
+		//server ignores ACKs from a stranger
+		filename := fmt.Sprintf("tid-file-%v", singlePort)
+		writeAndRead(t, c, filename, bytes.Repeat([]byte("t"), BLOCK_SIZE*2+10))
+		conn, _ := net.ListenUDP(UDP_NET, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		defer conn.Close()
+		conn.WriteToUDP((&RRQ{filename, TRANSFER_MODE, nil}).Pack(), addr)
+		buffer := make([]byte, MAX_DATAGRAM_SIZE)
+		received := 0
+		for block := uint16(1); ; block++ {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, from, err := conn.ReadFromUDP(buffer)
+			packet, _ := UnPack(buffer[:n])
+			data, ok := packet.(*DATA)
+			if err != nil || !ok || data.BlockNum != block {
+				t.Fatalf("Expected block %d, got %v (%v)", block, packet, err)
+			}
+			received += len(data.Data)
+			if block == 1 {
+				stray.WriteToUDP((&ACK{1}).Pack(), from)
+				rejected()
+			}
+			conn.WriteToUDP((&ACK{block}).Pack(), from)
+			if len(data.Data) < BLOCK_SIZE {
+				break
+			}
+		}
+		if received != BLOCK_SIZE*2+10 {
+			t.Fatalf("Received %d bytes", received)
+		}
+
+		//client ignores DATA from a stranger once it heard from the server
+		client := &Client{RemoteAddr: addr, Log: c.Log, BlockSize: 1024}
+		read := make(chan []byte, 1)
+		go func() {
+			buffer := new(bytes.Buffer)
+			client.Get("waiting", buffer)
+			read <- buffer.Bytes()
+		}()
+		from := <-clientAddr
+		time.Sleep(100*time.Millisecond)//let the client acknowledge the options
+		stray.WriteToUDP((&DATA{1, []byte("spoofed")}).Pack(), from)
+		rejected()
+		close(release)
+		if data := <-read; string(data) != "waited" {
+			t.Fatalf("Client received %s", data)
+		}
+	}
+}
+
+//many transfers run at once on a memory network of their own, even one that loses packets
+func TestMemoryNetwork(t *testing.T) {
+	forgetFiles(t)
+	quiet := log.New(io.Discard, "", 0)
+	lossy := &MemoryNetwork{}
+	packets := 0
+	//data and ACKs are lost, including the last ACKs of writes
+	lossy.Drop = func(packet []byte, from net.Addr, to net.Addr) bool {
+		if opcode := binary.BigEndian.Uint16(packet); opcode != OPCODE_DATA && opcode != OPCODE_ACK {
+			return false
+		}
+		packets++
+		return packets % 50 == 0
+	}
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Log: quiet, Transport: lossy, AdaptiveTimeout: true}
+	addr := startServer(t, server)
+	defer server.Close()
+	//the client resends a block whose ACK got lost before the server stops waiting for it
+	client := &Client{RemoteAddr: addr, Log: quiet, Transport: lossy, AdaptiveTimeout: true, MaxTimeout: time.Second}
+	var wait sync.WaitGroup
+	errs := make(chan error, 1000)
+	for i := 0; i < 1000; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			filename := fmt.Sprintf("memory-network-%d", i)
+			data := bytes.Repeat([]byte{byte(i)}, i)
+			_, err := client.Put(filename, bytes.NewReader(data))
+			if err != nil {
+				errs <- fmt.Errorf("Failed to write %s: %v", filename, err)
+				return
+			}
+			received := new(bytes.Buffer)
+			_, err = client.Get(filename, received)
+			if err != nil || !bytes.Equal(received.Bytes(), data) {
+				errs <- fmt.Errorf("Failed to read %s: %d of %d bytes (%v)", filename, received.Len(), len(data), err)
+			}
+		}()
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	//ports are not shared and reads end once a socket is closed
+	conn, err := lossy.ListenPacket(&net.UDPAddr{Port: 4000})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if _, err = lossy.ListenPacket(&net.UDPAddr{Port: 4000}); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("Expected port in use, got %v", err)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 10))
+		closed <- err
+	}()
+	conn.Close()
+	if err := <-closed; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Expected closed socket, got %v", err)
+	}
+}
+
+//servers and clients without a Log work the same, they just log nothing
+func TestNoLog(t *testing.T) {
+	forgetFiles(t)
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Transport: network, WritePolicy: WRITE_CREATE}
+	client := &Client{RemoteAddr: startServer(t, server), Transport: network}
+	defer server.Close()
+	writeAndRead(t, client, "no-log", []byte("nothing logged"))
+	var tftpErr *TFTPError
+	if _, err := client.Put("no-log", strings.NewReader("again")); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_FILE_EXISTS {
+		t.Fatalf("Expected file already exists, got %v", err)
+	}
+	if _, err := client.Get("no-log-missing", io.Discard); !errors.As(err, &tftpErr) || tftpErr.Code != ERROR_FILE_NOT_FOUND {
+		t.Fatalf("Expected file not found, got %v", err)
+	}
+}
+
+//starts a server on a free port and waits until it is listening
+func startServer(t *testing.T, server *Server) *net.UDPAddr {
+	if server.BindAddr == nil {
+		server.BindAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	}
+	go server.Startup()
+	for i := 0; i < 100; i++ {
+		if addr := server.Addr(); addr != nil {
+			return addr.(*net.UDPAddr)
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+	t.Fatalf("Server did not start")
+	return nil
+}
+
+//shutdown waits for running transfers and refuses new ones
+func TestShutdown(t *testing.T) {
+	forgetFiles(t)
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log}
+	addr := startServer(t, server)
+	client := &Client{RemoteAddr: addr, Log: c.Log, Timeout: 200*time.Millisecond, Retries: 2}
+	release := make(chan struct{})
+	written := make(chan error, 1)
+	go func() {
+		written <- client.WriteFile("shutdown-graceful", TRANSFER_MODE, func(w *io.PipeWriter) {
+			w.Write(bytes.Repeat([]byte("s"), BLOCK_SIZE))
+			<-release
+			w.Write([]byte("end"))
+			w.Close()
+		})
+	}()
+	time.Sleep(100*time.Millisecond)//let the transfer start
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+	select {
+		case err := <-shutdownErr:
+			t.Fatalf("Shutdown returned before the transfer finished: %v", err)
+		case <-time.After(100*time.Millisecond):
+	}
+	close(release)
+	if err := <-written; err != nil {
+		t.Fatalf("Transfer was not allowed to finish: %v", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if _, err := client.FileSize("shutdown-graceful", TRANSFER_MODE); err != ERR_RECEIVE_TIMEOUT {
+		t.Fatalf("Server still answers after shutdown: %v", err)
+	}
+}
+
+//a finished write that waits for repeats of its last block neither delays a shutdown nor keeps its port from new transfers
+func TestShutdownAfterWrite(t *testing.T) {
+	forgetFiles(t)
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, Transport: network, TransferPorts: PortRange{3040, 3040}}
+	client := &Client{RemoteAddr: startServer(t, server), Log: c.Log, Transport: network}
+	for i := 0; i < 2; i++ {
+		if _, err := client.Put(fmt.Sprintf("after-write-%d", i), strings.NewReader("x")); err != nil {
+			t.Fatalf("Write %d on the only transfer port failed: %v", i, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown took %v with nothing left to transfer", elapsed)
+	}
+}
+
+//transfers still running when the shutdown deadline passes are aborted
+func TestShutdownDeadline(t *testing.T) {
+	//file that takes far longer to send than the shutdown deadline
+	server := &Server{ReadHandler: ReadHandlerFunc(func(r *Request) (io.WriterTo, error) {
+		return endlessFile{}, nil
+	}), WriteHandler: memory, Log: s.Log}
+	addr := startServer(t, server)
+	client := &Client{RemoteAddr: addr, Log: c.Log}
+	read := make(chan error, 1)
+	go func() {
+		read <- client.ReadFile("shutdown-deadline", TRANSFER_MODE, func(r *io.PipeReader) {
+			io.Copy(io.Discard, r)
+		})
+	}()
+	time.Sleep(100*time.Millisecond)//let the transfer start
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	var tftpErr *TFTPError
+	if err := <-read; !errors.As(err, &tftpErr) {
+		t.Fatalf("Client was not told about the aborted transfer: %v", err)
+	}
+}
+
+//close aborts transfers right away and makes Startup return
+func TestClose(t *testing.T) {
+	forgetFiles(t)
+	server := &Server{BindAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, ReadHandler: memory, WriteHandler: memory, Log: s.Log}
+	startupErr := make(chan error, 1)
+	go func() {
+		startupErr <- server.Startup()
+	}()
+	for server.Addr() == nil {
+		time.Sleep(10*time.Millisecond)
+	}
+	client := &Client{RemoteAddr: server.Addr().(*net.UDPAddr), Log: c.Log}
+	written := make(chan error, 1)
+	go func() {
+		written <- client.WriteFile("close-abort", TRANSFER_MODE, func(w *io.PipeWriter) {
+			for {
+				_, err := w.Write(bytes.Repeat([]byte("c"), BLOCK_SIZE))
+				if err != nil {
+					return
+				}
+				time.Sleep(10*time.Millisecond)
+			}
+		})
+	}()
+	time.Sleep(100*time.Millisecond)//let the transfer start
+	server.Close()
+	if err := <-startupErr; err != ERR_SERVER_CLOSED {
+		t.Fatalf("Expected server closed, got %v", err)
+	}
+	var tftpErr *TFTPError
+	if err := <-written; !errors.As(err, &tftpErr) {
+		t.Fatalf("Client was not told about the aborted transfer: %v", err)
+	}
+}
+
+//a write only holds up transfers of the same file
+func TestFileLocks(t *testing.T) {
+	forgetFiles(t)
+	server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, Locks: NewFileLocker()}
+	addr := startServer(t, server)
+	defer server.Close()
+	client := &Client{RemoteAddr: addr, Log: c.Log, Locks: NewFileLocker()}
+	writeAndRead(t, client, "locks-other", []byte("other file"))
+
+	release := make(chan struct{})
+	written := make(chan error, 1)
+	go func() {
+		written <- client.WriteFile("locks-busy", TRANSFER_MODE, func(w *io.PipeWriter) {
+			w.Write(bytes.Repeat([]byte("l"), BLOCK_SIZE))
+			<-release
+			w.Close()
+		})
+	}()
+	time.Sleep(100*time.Millisecond)//let the write start
+	err := client.ReadFile("locks-other", TRANSFER_MODE, func(r *io.PipeReader) {
+		io.Copy(io.Discard, r)
+	})
+	if err != nil {
+		t.Fatalf("Reading another file failed while a write was running: %v", err)
+	}
+
+	read := make(chan error, 1)
+	go func() {
+		read <- client.ReadFile("locks-busy", TRANSFER_MODE, func(r *io.PipeReader) {
+			io.Copy(io.Discard, r)
+		})
+	}()
+	select {
+		case err := <-read:
+			t.Fatalf("Read of a file did not wait for its write: %v", err)
+		case <-time.After(100*time.Millisecond):
+	}
+	close(release)
+	if err := <-written; err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := <-read; err != nil {
+		t.Fatalf("Read after the write failed: %v", err)
+	}
+}
+
+//only one of two writes of the same new file succeeds under WRITE_CREATE, even without Locks
+func TestConcurrentCreate(t *testing.T) {
+	forgetFiles(t)
+	filename := "concurrent-create"
+	release := make(chan struct{})
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		//clients of their own, so they do not wait for each other
+		client := &Client{RemoteAddr: c.RemoteAddr, Log: c.Log, Transport: network, Locks: NewFileLocker()}
+		go func() {
+			errs <- client.WriteFile(filename, TRANSFER_MODE, func(w *io.PipeWriter) {
+				w.Write(bytes.Repeat([]byte("c"), BLOCK_SIZE))
+				<-release
+				w.Close()
+			})
+		}()
+		time.Sleep(100*time.Millisecond)//let the write start
+	}
+	close(release)
+	var tftpErr *TFTPError
+	succeeded, refused := 0, 0
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err == nil {
+			succeeded++
+		} else if errors.As(err, &tftpErr) && tftpErr.Code == ERROR_FILE_EXISTS {
+			refused++
+		} else {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if succeeded != 1 || refused != 1 {
+		t.Fatalf("Expected one write to succeed and one to be refused, %d succeeded", succeeded)
+	}
+}
+
+//a second write of a file that is still being written is refused right away,
+//even when the first write takes longer than the second client would wait for an answer
+func TestConcurrentWriteRefused(t *testing.T) {
+	forgetFiles(t)
+	for _, policy := range []WritePolicy{WRITE_CREATE, WRITE_REPLACE} {
+		filename := fmt.Sprintf("concurrent-write-%d", policy)
+		if policy == WRITE_REPLACE {
+			mutex.Lock()
+			m[filename] = []byte("old")
+			mutex.Unlock()
+		}
+		server := &Server{ReadHandler: memory, WriteHandler: memory, Log: s.Log, Transport: network, WritePolicy: policy}
+		addr := startServer(t, server)
+		release := make(chan struct{})
+		first := make(chan error, 1)
+		go func() {
+			client := &Client{RemoteAddr: addr, Log: c.Log, Transport: network, Locks: NewFileLocker()}
+			first <- client.WriteFile(filename, TRANSFER_MODE, func(w *io.PipeWriter) {
+				w.Write(bytes.Repeat([]byte("f"), BLOCK_SIZE))
+				<-release
+				w.Close()
+			})
+		}()
+		time.Sleep(100*time.Millisecond)//let the write start
+		//gives up after one second without an answer
+		second := &Client{RemoteAddr: addr, Log: c.Log, Transport: network, Locks: NewFileLocker(), Timeout: time.Second, Retries: 1}
+		start := time.Now()
+		_, err := second.Put(filename, strings.NewReader("second"))
+		elapsed := time.Since(start)
+		close(release)
+		var tftpErr *TFTPError
+		expected := ERROR_FILE_EXISTS
+		if policy == WRITE_REPLACE {
+			expected = ERROR_ACCESS_VIOLATION
+		}
+		if !errors.As(err, &tftpErr) || tftpErr.Code != expected {
+			t.Fatalf("Expected error %d for policy %d, got %v", expected, policy, err)
+		} else if elapsed > 500*time.Millisecond {
+			t.Fatalf("Took %v to refuse the write", elapsed)
+		}
+		if err := <-first; err != nil {
+			t.Fatalf("First write failed: %v", err)
+		}
+		server.Close()
+	}
+}
+
+//locks are dropped once nobody uses them
+func TestFileLockerCleanup(t *testing.T) {
+	locks := NewFileLocker().(*fileLocks)
+	locks.RLock("a")
+	locks.RLock("a")
+	locks.RUnlock("a")
+	locks.RUnlock("a")
+	locks.Lock("b")
+	locks.Unlock("b")
+	if len(locks.locks) != 0 {
+		t.Fatalf("Unused locks were kept: %v", locks.locks)
+	}
+}
+
+//handler serving the files in memory
+type memoryFiles struct{}
+
+var memory memoryFiles
+
+//function receiver uses to handle writes to it
+//refuses files that would not fit in memory
+func (memoryFiles) ServeWrite(r *Request) (io.ReaderFrom, error) {
+	if r.TransferSize > MAX_FILE_SIZE {
+		return nil, &TFTPError{ERROR_DISK_FULL, fmt.Sprintf("File too large: %d bytes", r.TransferSize)}
+	}
+	return &memoryFile{name: r.FileName}, nil
+}
+
+//function sender uses to send data to receiver
+func (memoryFiles) ServeRead(r *Request) (io.WriterTo, error) {
+	mutex.Lock()
+	data, exists := m[r.FileName]
+	mutex.Unlock()
+	if !exists {
+		return nil, &TFTPError{ERROR_FILE_NOT_FOUND, fmt.Sprintf("File not found: %s", r.FileName)}
+	}
+	return bytes.NewReader(data), nil
+}
+
+//lets the server refuse to write files that already exist in memory
+func (memoryFiles) FileExists(filename string) (bool, error) {
+	mutex.Lock()
 	defer mutex.Unlock()
-}
\ No newline at end of file
+	_, exists := m[filename]
+	return exists, nil
+}
+
+//file written to memory. It is only stored once all of it was received
+//the memory is only locked while it is accessed so that transfers of different files run in parallel
+type memoryFile struct {
+	name 	string
+	buffer 	bytes.Buffer
+}
+
+func (f *memoryFile) ReadFrom(r io.Reader) (int64, error) {
+	datalength, err := f.buffer.ReadFrom(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v", f.name, err)
+		return datalength, err
+	}
+	fmt.Fprintf(os.Stderr, "Received %s (%d bytes)", f.name, datalength)
+	mutex.Lock()
+	m[f.name] = f.buffer.Bytes()
+	mutex.Unlock()
+	return datalength, nil
+}
+
+//file that is sent once the channel is closed
+type waitingFile chan struct{}
+
+func (f waitingFile) WriteTo(w io.Writer) (int64, error) {
+	<-f
+	n, err := w.Write([]byte("waited"))
+	return int64(n), err
+}
+
+//file that never ends, written slowly
+type endlessFile struct{}
+
+func (endlessFile) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		n, err := w.Write(bytes.Repeat([]byte("s"), BLOCK_SIZE))
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(10*time.Millisecond)
+	}
+}